@@ -45,7 +45,10 @@ func HandleCommand(command string) {
 	if strings.HasPrefix(command, "create") {
 		parts := strings.Split(command, " ")
 		id := parts[1]
-		SendAll(fmt.Sprintf("create %s", id))
+		// Anything after the id is the context's settings, like
+		// policy=majority.
+		settings := strings.TrimPrefix(command, "create "+id)
+		SendAll(fmt.Sprintf("create %s%s", id, settings))
 	}
 	if strings.HasPrefix(command, "query") {
 		parts := strings.Split(command, " ")
@@ -59,6 +62,14 @@ func HandleCommand(command string) {
 		responseNumber := parts[2]
 		SendAll(fmt.Sprintf("choose %s %s", id, responseNumber))
 	}
+	if strings.HasPrefix(command, "ingest") {
+		SendAll(command)
+		return
+	}
+	if strings.HasPrefix(command, "usage") {
+		SendAll(command)
+		return
+	}
 	if strings.HasPrefix(command, "viewall") {
 		SendAll("viewall")
 		return
@@ -92,7 +103,11 @@ func handleMessage(w http.ResponseWriter, r *http.Request) {
 	src := parts[0]
 	dest := parts[1]
 	messageContent := parts[2]
-	ForwardMessage(src, dest, messageContent)
+	// A node that is down is reported, so the sender can retry; a failed
+	// link drops the message silently, like a real partition.
+	if err := ForwardMessage(src, dest, messageContent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
 }
 
 func SendMessage(dest string, message string) error {
@@ -105,6 +120,9 @@ func SendMessage(dest string, message string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", dest, resp.Status)
+	}
 	return nil
 }
 
@@ -120,10 +138,11 @@ func ForwardAll(src string, message string) {
 	}
 }
 
-func ForwardMessage(src string, dest string, message string) {
+func ForwardMessage(src string, dest string, message string) error {
 	if CanForwardMessage(src, dest) {
-		SendMessage(dest, message)
+		return SendMessage(dest, message)
 	}
+	return nil
 }
 
 func CanForwardMessage(src string, dest string) bool {
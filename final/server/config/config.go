@@ -1,14 +1,90 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var IsLeader = false
 var LeaderPort = 7000
 
 var Port = os.Getenv("PORT")
+
+// Followers are the other nodes' ports.
+var Followers = []string{"7001", "7002"}
 var ProxyPort = "7005"
 var GeminiAPIKey = os.Getenv("GEMINI_API_KEY")
 
+// Model is the node's default model. Nodes may use different ones, so
+// that their candidates differ more.
+var Model = stringEnv("LLM_MODEL", "gemini-1.5-flash")
+
+// QueryTimeout bounds each call to the LLM, and QueryRetries is how many
+// more times a call that failed with a retryable error is tried.
+var QueryTimeout = durationEnv("LLM_TIMEOUT", 30*time.Second)
+var QueryRetries = intEnv("LLM_RETRIES", 3)
+
+// SelectionTimeout is how long a context's selection policy waits for
+// every candidate before choosing among those that arrived.
+var SelectionTimeout = durationEnv("SELECTION_TIMEOUT", time.Minute)
+
+// Candidates is how many answers each node asks the model for.
+var Candidates = intEnv("LLM_CANDIDATES", 1)
+
+// ContextTokens caps the tokens of history sent with a query, well under
+// the model's limit to bound latency and cost, and ContextPolicy is how
+// contexts that do not set one keep within it: window, drop or summarize.
+var ContextTokens = intEnv("LLM_CONTEXT_TOKENS", 32000)
+var ContextPolicy = stringEnv("LLM_CONTEXT_POLICY", "drop")
+
+// RateLimit is how many calls a minute each node makes with the API key,
+// in bursts of up to RateBurst. 0 turns the limit off.
+var RateLimit = intEnv("LLM_RATE_LIMIT", 60)
+var RateBurst = intEnv("LLM_RATE_BURST", 5)
+
+// Budgets on each node's own use of the model, 0 for none, in tokens or
+// US dollars. Queries over a daily budget are rejected until the day is
+// over in UTC, and over a context's budget for good.
+var DailyTokenBudget = intEnv("LLM_DAILY_TOKENS", 0)
+var DailyCostBudget = floatEnv("LLM_DAILY_COST", 0)
+var ContextTokenBudget = intEnv("LLM_CONTEXT_TOKEN_BUDGET", 0)
+
+// ToolRounds caps how many times the model may call tools before it
+// answers. The files tool reads under ToolsDir, and fetch only reaches the
+// host:port pairs in FetchAllow, both off when unset.
+var ToolRounds = intEnv("LLM_TOOL_ROUNDS", 5)
+var ToolsDir = os.Getenv("TOOLS_DIR")
+var FetchAllow = listEnv("TOOLS_FETCH_ALLOW")
+
+// RAGDocs is a file or directory of documents to ingest at startup, and
+// RAGIndex where to keep their chunks and vectors between runs. Documents
+// are split into chunks of RAGChunkWords words, overlapping by
+// RAGChunkOverlap, and embedded with RAGEmbedder: hash, which is local and
+// deterministic, or gemini.
+var RAGDocs = os.Getenv("RAG_DOCS")
+var RAGIndex = os.Getenv("RAG_INDEX")
+var RAGEmbedder = stringEnv("RAG_EMBEDDER", "hash")
+var RAGChunkWords = intEnv("RAG_CHUNK_WORDS", 200)
+var RAGChunkOverlap = intEnv("RAG_CHUNK_OVERLAP", 40)
+
+// Answers are cached for CacheTTL, up to CacheSize of them, and kept in
+// CacheDir across restarts if it is set. Nodes should not share a
+// directory. A TTL or size of 0 turns caching off.
+var CacheTTL = durationEnv("LLM_CACHE_TTL", time.Hour)
+var CacheSize = intEnv("LLM_CACHE_SIZE", 1000)
+var CacheDir = os.Getenv("LLM_CACHE_DIR")
+
+// Stream sends text to the leader as it is generated, not only once the
+// answer is complete.
+var Stream = os.Getenv("LLM_STREAM") != "false"
+
+// After BreakerThreshold failed calls in a row the provider is not called
+// for BreakerCooldown.
+var BreakerThreshold = intEnv("LLM_BREAKER_THRESHOLD", 5)
+var BreakerCooldown = durationEnv("LLM_BREAKER_COOLDOWN", 30*time.Second)
+
 func Validate() {
 	if GeminiAPIKey == "" {
 		panic("GEMINI_API_KEY is not set")
@@ -17,3 +93,58 @@ func Validate() {
 		IsLeader = true
 	}
 }
+
+// NodeIndex numbers the nodes from the leader, 0, through the followers in
+// order.
+func NodeIndex() int {
+	if IsLeader {
+		return 0
+	}
+	for i, port := range Followers {
+		if port == Port {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func intEnv(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func floatEnv(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func listEnv(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func stringEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -46,7 +46,7 @@ func PrepareProposal(instanceID string, value string) {
 		instanceID)
 
 	// Send prepare messages to all nodes
-	for _, port := range []string{"7001", "7002"} {
+	for _, port := range config.Followers {
 		SendPrepare(port, instanceID, proposal)
 	}
 }
@@ -1,28 +1,81 @@
 package database
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
+// DB holds each context's history. Selection policies and summaries
+// update it from their own goroutines, so it is only used under dbMutex.
 var DB map[string]string
+var dbMutex sync.RWMutex
 
 func Initialize() {
+	dbMutex.Lock()
 	DB = make(map[string]string)
+	queries = make(map[string]int)
+	dbMutex.Unlock()
 	ResetResponses()
 }
 
 func Get(key string) string {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
 	return DB[key]
 }
 
 func Set(key string, value string) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
 	DB[key] = value
 }
 
+// Append adds text to a context's history in one step, so that concurrent
+// appends are not lost.
+func Append(key string, text string) string {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	DB[key] += text
+	return DB[key]
+}
+
+// Update replaces a context's history with what update makes of it, in one
+// step.
+func Update(key string, update func(history string) string) string {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	DB[key] = update(DB[key])
+	return DB[key]
+}
+
 func CreateContext(key string) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
 	if _, ok := DB[key]; !ok {
-		Set(key, "")
+		DB[key] = ""
 	}
 }
 
+// queries counts the queries asked on each context, under dbMutex.
+var queries map[string]int
+
+// NextQuery numbers a new query on a context. Every node sees the same
+// queries, so the numbers agree; candidates and failures carry them, so
+// those for an earlier query can be dropped.
+func NextQuery(key string) int {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	queries[key]++
+	return queries[key]
+}
+
+// CurrentQuery is the number of the context's latest query.
+func CurrentQuery(key string) int {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+	return queries[key]
+}
+
 func PrintContext(key string) {
 	println(fmt.Sprintf("-------- CONTEXT %s --------", key))
 	println(Get(key))
@@ -31,21 +84,85 @@ func PrintContext(key string) {
 
 func PrintContexts() {
 	println("======= ALL CONTEXTS =======")
+	dbMutex.RLock()
+	keys := make([]string, 0, len(DB))
 	for k := range DB {
+		keys = append(keys, k)
+	}
+	dbMutex.RUnlock()
+	for _, k := range keys {
 		PrintContext(k)
 	}
 	println("================================")
 }
 
-var Responses map[string]string
+// The candidates for the current query, by candidate ID, all guarded by
+// responsesMutex.
+var (
+	responses map[string]string
+	// details notes anything unusual about a response, like truncation
+	// or safety ratings.
+	details map[string]string
+	// turns holds the history turns to commit with a response: the
+	// documents it was given and the tool calls behind it.
+	turns map[string]string
+	// failures holds why a node could not answer.
+	failures       map[string]string
+	responsesMutex sync.Mutex
+)
 
 func ResetResponses() {
-	Responses = make(map[string]string)
+	responsesMutex.Lock()
+	defer responsesMutex.Unlock()
+	responses = make(map[string]string)
+	details = make(map[string]string)
+	turns = make(map[string]string)
+	failures = make(map[string]string)
+}
+
+// SetResponse records a candidate with its details and turns, either of
+// which may be empty.
+func SetResponse(candidate string, response string, detail string, turn string) {
+	responsesMutex.Lock()
+	defer responsesMutex.Unlock()
+	responses[candidate] = response
+	if detail != "" {
+		details[candidate] = detail
+	}
+	if turn != "" {
+		turns[candidate] = turn
+	}
+}
+
+// GetResponse returns a candidate and the turns to commit with it.
+func GetResponse(candidate string) (string, string) {
+	responsesMutex.Lock()
+	defer responsesMutex.Unlock()
+	return responses[candidate], turns[candidate]
+}
+
+func SetFailure(candidate string, reason string) {
+	responsesMutex.Lock()
+	defer responsesMutex.Unlock()
+	failures[candidate] = reason
+}
+
+// GetFailure returns why a candidate failed, if it did.
+func GetFailure(candidate string) (string, bool) {
+	responsesMutex.Lock()
+	defer responsesMutex.Unlock()
+	reason, failed := failures[candidate]
+	return reason, failed
 }
 
 func DebugDumpResponses() {
+	responsesMutex.Lock()
+	defer responsesMutex.Unlock()
 	println("-------- DEBUG DUMP RESPONSES --------")
-	for k, v := range Responses {
+	for k, v := range responses {
 		fmt.Printf("(%s) Response %s: %s\n", k, k, v)
 	}
+	for k, v := range failures {
+		fmt.Printf("(%s) Failure %s: %s\n", k, k, v)
+	}
 }
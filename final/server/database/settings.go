@@ -0,0 +1,84 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Settings are a context's options, given to create as key=value pairs.
+// Values with spaces are double quoted: system="Be brief.".
+type Settings map[string]string
+
+var ContextSettings = make(map[string]Settings)
+var settingsMutex sync.RWMutex
+
+func SetSettings(key string, settings Settings) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	ContextSettings[key] = settings
+}
+
+// GetSettings never returns nil, so lookups on unknown contexts see the
+// defaults.
+func GetSettings(key string) Settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	if settings, ok := ContextSettings[key]; ok {
+		return settings
+	}
+	return Settings{}
+}
+
+// ParseSettings parses "key=value key2="quoted value"".
+func ParseSettings(text string) (Settings, error) {
+	settings := Settings{}
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \"") {
+			return nil, fmt.Errorf("expected key=value, got %q", rest)
+		}
+		if strings.HasPrefix(value, "\"") {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quote in %s", key)
+			}
+			settings[key], _ = strconv.Unquote(quoted)
+			rest = value[len(quoted):]
+		} else {
+			end := strings.IndexByte(value, ' ')
+			if end < 0 {
+				end = len(value)
+			}
+			settings[key] = value[:end]
+			rest = value[end:]
+		}
+		if rest != "" && !strings.HasPrefix(rest, " ") {
+			return nil, fmt.Errorf("expected a space after %s", key)
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	return settings, nil
+}
+
+// String formats settings for ParseSettings, sorted by key so every
+// replica sees the same text.
+func (s Settings) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		value := s[k]
+		if value == "" || strings.ContainsAny(value, " \"\\\n\t") {
+			value = strconv.Quote(value)
+		}
+		parts = append(parts, k+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
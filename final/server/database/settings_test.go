@@ -0,0 +1,65 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSettingsRoundTrip(t *testing.T) {
+	tests := []Settings{
+		{},
+		{"policy": "majority"},
+		{"policy": "first", "timeout": "30s", "temperature": "0.5"},
+		{"system": "Be brief."},
+		{"system": `Say "hi" \ then stop`},
+		{"system": "two\nlines\tand a tab"},
+		{"empty": ""},
+		{"expr": "a=b"},
+		{"unicode": "héllo wörld"},
+	}
+	for _, settings := range tests {
+		text := settings.String()
+		got, err := ParseSettings(text)
+		if err != nil {
+			t.Errorf("ParseSettings(%q): %v", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, settings) {
+			t.Errorf("round trip of %q = %v, want %v", text, got, settings)
+		}
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	tests := []struct {
+		text string
+		want Settings
+	}{
+		{"", Settings{}},
+		{"  policy=first   timeout=5s ", Settings{"policy": "first", "timeout": "5s"}},
+		{`system="Be brief." policy=first`, Settings{"system": "Be brief.", "policy": "first"}},
+		{"policy=first policy=longest", Settings{"policy": "longest"}},
+	}
+	for _, test := range tests {
+		got, err := ParseSettings(test.text)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseSettings(%q) = %v, %v, want %v", test.text, got, err, test.want)
+		}
+	}
+}
+
+func TestParseSettingsRejects(t *testing.T) {
+	tests := []string{
+		"policy",
+		"=first",
+		"policy =first",
+		`"policy"=first`,
+		`system="Be brief.`,
+		`system="Be brief."policy=first`,
+	}
+	for _, text := range tests {
+		if got, err := ParseSettings(text); err == nil {
+			t.Errorf("ParseSettings(%q) = %v, want an error", text, got)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.22.3
 require (
 	github.com/google/generative-ai-go v0.19.0
 	google.golang.org/api v0.210.0
+	google.golang.org/grpc v1.67.1
 )
 
 require (
@@ -37,6 +38,5 @@ require (
 	golang.org/x/time v0.8.0 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20241104194629-dd2ea8efbc28 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241118233622-e639e219e697 // indirect
-	google.golang.org/grpc v1.67.1 // indirect
 	google.golang.org/protobuf v1.35.2 // indirect
 )
@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	closed breakerState = iota
+	open
+	halfOpen
+)
+
+// Breaker stops calls to a provider that keeps failing. After Threshold
+// failures in a row it opens and rejects calls for Cooldown, then lets a
+// single trial call through; the trial's outcome closes or reopens it.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+var breakers = make(map[string]*Breaker)
+var breakersMutex sync.Mutex
+
+func breakerFor(provider string, threshold int, cooldown time.Duration) *Breaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	b, ok := breakers[provider]
+	if !ok {
+		b = &Breaker{Threshold: threshold, Cooldown: cooldown}
+		breakers[provider] = b
+	}
+	return b
+}
+
+// Allow reports whether a call may go ahead.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case open:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = halfOpen
+		return true
+	case halfOpen:
+		// The trial call is still running.
+		return false
+	}
+	return true
+}
+
+// Record reports the outcome of an allowed call. Errors that say nothing
+// about the provider's health, like a bad request, count as success.
+func (b *Breaker) Record(healthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if healthy {
+		b.state, b.failures = closed, 0
+		return
+	}
+	b.failures++
+	if b.state == halfOpen || b.failures >= b.Threshold {
+		b.state, b.openedAt = open, time.Now()
+	}
+}
+
+func (b *Breaker) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return [...]string{"closed", "open", "half-open"}[b.state]
+}
@@ -0,0 +1,61 @@
+package llm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	// Each step is "allow" or "deny", which Allow must answer, "ok" or
+	// "fail", which Record the outcome of a call, or "cooldown", which
+	// lets the cooldown pass. want is the state after the step.
+	type step struct {
+		do   string
+		want string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"stays closed below the threshold", []step{
+			{"fail", "closed"}, {"fail", "closed"}, {"allow", "closed"},
+		}},
+		{"a success resets the count", []step{
+			{"fail", "closed"}, {"fail", "closed"}, {"ok", "closed"}, {"fail", "closed"}, {"fail", "closed"},
+		}},
+		{"opens at the threshold", []step{
+			{"fail", "closed"}, {"fail", "closed"}, {"fail", "open"}, {"deny", "open"},
+		}},
+		{"one trial after the cooldown", []step{
+			{"fail", "closed"}, {"fail", "closed"}, {"fail", "open"},
+			{"cooldown", "open"}, {"allow", "half-open"}, {"deny", "half-open"},
+		}},
+		{"a good trial closes", []step{
+			{"fail", "closed"}, {"fail", "closed"}, {"fail", "open"},
+			{"cooldown", "open"}, {"allow", "half-open"}, {"ok", "closed"}, {"allow", "closed"},
+		}},
+		{"a bad trial reopens at once", []step{
+			{"fail", "closed"}, {"fail", "closed"}, {"fail", "open"},
+			{"cooldown", "open"}, {"allow", "half-open"}, {"fail", "open"}, {"deny", "open"},
+			{"cooldown", "open"}, {"allow", "half-open"},
+		}},
+	}
+	for _, test := range tests {
+		b := &Breaker{Threshold: 3, Cooldown: time.Minute}
+		for i, s := range test.steps {
+			switch s.do {
+			case "allow", "deny":
+				if got := b.Allow(); got != (s.do == "allow") {
+					t.Errorf("%s: step %d: Allow = %t, want %t", test.name, i, got, s.do == "allow")
+				}
+			case "ok", "fail":
+				b.Record(s.do == "ok")
+			case "cooldown":
+				b.openedAt = b.openedAt.Add(-b.Cooldown)
+			}
+			if got := b.String(); got != s.want {
+				t.Errorf("%s: step %d (%s): state %s, want %s", test.name, i, s.do, got, s.want)
+			}
+		}
+	}
+}
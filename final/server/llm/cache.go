@@ -0,0 +1,263 @@
+package llm
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server/tools"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps answers to prompts already asked with the same model and
+// settings, like when history is replayed after recovery, so they are not
+// paid for twice. Entries expire after a TTL and the least recently used
+// are evicted beyond a size limit. With a directory they are also kept on
+// disk, one JSON file per entry, and survive restarts.
+type Cache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	dir     string
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front.
+	order *list.List
+}
+
+type cacheEntry struct {
+	Key        string            `json:"key"`
+	Created    time.Time         `json:"created"`
+	Candidates []cachedCandidate `json:"candidates"`
+}
+
+type cachedCandidate struct {
+	Text         string       `json:"text"`
+	FinishReason string       `json:"finish_reason,omitempty"`
+	Safety       []string     `json:"safety,omitempty"`
+	Tools        []tools.Call `json:"tools,omitempty"`
+	// Kind is "blocked", "empty" or "truncated" when Error is set.
+	Kind  string `json:"kind,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// cachedError gives back a cached candidate's error, still matching
+// ErrBlocked, ErrEmpty or ErrTruncated.
+type cachedError struct {
+	kind    error
+	message string
+}
+
+func (e *cachedError) Error() string { return e.message }
+func (e *cachedError) Unwrap() error { return e.kind }
+
+var errorKinds = map[string]error{
+	"blocked":   ErrBlocked,
+	"empty":     ErrEmpty,
+	"truncated": ErrTruncated,
+}
+
+// NewCache returns nil, which caches nothing, if ttl or size is not
+// positive. Files in dir that expired or are beyond size are removed.
+func NewCache(ttl time.Duration, size int, dir string) *Cache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	c := &Cache{
+		ttl:     ttl,
+		size:    size,
+		dir:     dir,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			fmt.Printf("Cannot create cache directory, caching in memory only: %v\n", err)
+			c.dir = ""
+		} else {
+			c.prune()
+		}
+	}
+	return c
+}
+
+// cacheKey hashes everything that changes the answer.
+func cacheKey(model string, params Params, candidates int, prompt string) string {
+	hash := sha256.New()
+	for _, part := range []string{Provider, model, params.String(), fmt.Sprint(candidates), prompt} {
+		fmt.Fprintf(hash, "%d:%s;", len(part), part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Get returns the cached candidates for key, marked as cached.
+func (c *Cache) Get(key string) ([]Candidate, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		entry, err := c.read(key)
+		if err != nil {
+			return nil, false
+		}
+		element = c.addLocked(entry)
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Since(entry.Created) > c.ttl {
+		c.removeLocked(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	result := make([]Candidate, len(entry.Candidates))
+	for i, cached := range entry.Candidates {
+		result[i] = Candidate{
+			Text:         cached.Text,
+			FinishReason: cached.FinishReason,
+			Safety:       cached.Safety,
+			Tools:        cached.Tools,
+			CachedAt:     entry.Created,
+		}
+		if cached.Error != "" {
+			result[i].Err = &cachedError{kind: errorKinds[cached.Kind], message: cached.Error}
+		}
+	}
+	return result, true
+}
+
+// Put caches candidates for key.
+func (c *Cache) Put(key string, candidates []Candidate) {
+	if c == nil {
+		return
+	}
+	entry := &cacheEntry{Key: key, Created: time.Now()}
+	for _, candidate := range candidates {
+		cached := cachedCandidate{
+			Text:         candidate.Text,
+			FinishReason: candidate.FinishReason,
+			Safety:       candidate.Safety,
+			Tools:        candidate.Tools,
+		}
+		if candidate.Err != nil {
+			cached.Error = candidate.Err.Error()
+			for kind, err := range errorKinds {
+				if errors.Is(candidate.Err, err) {
+					cached.Kind = kind
+				}
+			}
+		}
+		entry.Candidates = append(entry.Candidates, cached)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeLocked(element)
+	}
+	c.addLocked(entry)
+	if err := c.write(entry); err != nil {
+		fmt.Printf("Cannot write cache entry: %v\n", err)
+	}
+}
+
+func (c *Cache) addLocked(entry *cacheEntry) *list.Element {
+	element := c.order.PushFront(entry)
+	c.entries[entry.Key] = element
+	for c.order.Len() > c.size {
+		c.removeLocked(c.order.Back())
+	}
+	return element
+}
+
+func (c *Cache) removeLocked(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.Key)
+	if c.dir != "" {
+		os.Remove(c.path(entry.Key))
+	}
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *Cache) read(key string) (*cacheEntry, error) {
+	if c.dir == "" {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key {
+		os.Remove(c.path(key))
+		return nil, fmt.Errorf("corrupt cache entry %s", key)
+	}
+	return &entry, nil
+}
+
+// write saves the entry through a temporary file, so a crash never leaves
+// half an entry behind.
+func (c *Cache) write(entry *cacheEntry) error {
+	if c.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(c.dir, "entry-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), c.path(entry.Key))
+}
+
+// prune removes expired entries and leftovers from the directory, and the
+// oldest entries beyond the size limit.
+func (c *Cache) prune() {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type stored struct {
+		name     string
+		modified time.Time
+	}
+	var kept []stored
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || file.IsDir() {
+			continue
+		}
+		path := filepath.Join(c.dir, file.Name())
+		if !strings.HasSuffix(file.Name(), ".json") || time.Since(info.ModTime()) > c.ttl {
+			os.Remove(path)
+			continue
+		}
+		kept = append(kept, stored{file.Name(), info.ModTime()})
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].modified.After(kept[j].modified) })
+	for _, file := range kept[min(len(kept), c.size):] {
+		os.Remove(filepath.Join(c.dir, file.name))
+	}
+}
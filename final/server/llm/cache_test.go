@@ -0,0 +1,143 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func answer(text string) []Candidate {
+	return []Candidate{{Text: text, FinishReason: "STOP"}}
+}
+
+// age makes the entry for key look as if it was cached d ago.
+func age(c *Cache, key string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key].Value.(*cacheEntry).Created = time.Now().Add(-d)
+}
+
+func TestNewCacheDisabled(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		size int
+	}{
+		{0, 10},
+		{-time.Minute, 10},
+		{time.Minute, 0},
+		{time.Minute, -1},
+	}
+	for _, test := range tests {
+		c := NewCache(test.ttl, test.size, "")
+		if c != nil {
+			t.Errorf("NewCache(%s, %d) = %v, want nil", test.ttl, test.size, c)
+		}
+		// A nil cache caches nothing.
+		c.Put("key", answer("a"))
+		if _, ok := c.Get("key"); ok {
+			t.Errorf("Get on a nil cache found an entry")
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration
+		hit  bool
+	}{
+		{"fresh", 0, true},
+		{"just inside the TTL", 59 * time.Second, true},
+		{"expired", 61 * time.Second, false},
+	}
+	for _, test := range tests {
+		c := NewCache(time.Minute, 10, "")
+		c.Put("key", answer("a"))
+		age(c, "key", test.age)
+		got, ok := c.Get("key")
+		if ok != test.hit {
+			t.Errorf("%s: Get hit = %t, want %t", test.name, ok, test.hit)
+			continue
+		}
+		if !ok {
+			if _, kept := c.entries["key"]; kept {
+				t.Errorf("%s: expired entry was kept", test.name)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0].Text != "a" || got[0].CachedAt.IsZero() {
+			t.Errorf("%s: Get = %+v, want the answer marked as cached", test.name, got)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		// ops puts a key, or gets it when prefixed with "?".
+		ops  []string
+		kept []string
+		gone []string
+	}{
+		{"oldest beyond the size", []string{"a", "b", "c"}, []string{"b", "c"}, []string{"a"}},
+		{"a get makes an entry recent", []string{"a", "b", "?a", "c"}, []string{"a", "c"}, []string{"b"}},
+		{"a put again makes an entry recent", []string{"a", "b", "a", "c"}, []string{"a", "c"}, []string{"b"}},
+	}
+	for _, test := range tests {
+		c := NewCache(time.Minute, 2, "")
+		for _, op := range test.ops {
+			if op[0] == '?' {
+				c.Get(op[1:])
+			} else {
+				c.Put(op, answer(op))
+			}
+		}
+		for _, key := range test.kept {
+			if got, ok := c.Get(key); !ok || got[0].Text != key {
+				t.Errorf("%s: Get(%s) = %+v, %t, want it kept", test.name, key, got, ok)
+			}
+		}
+		for _, key := range test.gone {
+			if _, ok := c.Get(key); ok {
+				t.Errorf("%s: Get(%s) hit, want it evicted", test.name, key)
+			}
+		}
+	}
+}
+
+func TestCacheOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(time.Minute, 2, dir)
+	blocked := fmt.Errorf("%w: safety", ErrBlocked)
+	c.Put("a", []Candidate{{Text: "a"}, {Err: blocked}})
+
+	// A new cache on the same directory is a restart.
+	c = NewCache(time.Minute, 2, dir)
+	got, ok := c.Get("a")
+	if !ok || len(got) != 2 || got[0].Text != "a" {
+		t.Fatalf("Get after a restart = %+v, %t, want both candidates", got, ok)
+	}
+	if !errors.Is(got[1].Err, ErrBlocked) || got[1].Err.Error() != blocked.Error() {
+		t.Errorf("cached error = %v, want %v still matching ErrBlocked", got[1].Err, blocked)
+	}
+
+	c.Put("b", answer("b"))
+	c.Put("c", answer("c"))
+	if _, err := os.Stat(c.path("a")); !os.IsNotExist(err) {
+		t.Errorf("evicted entry's file was kept: %v", err)
+	}
+
+	// Expired files and leftovers are pruned on start, and the oldest
+	// beyond the size.
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(c.path("b"), old, old)
+	os.WriteFile(filepath.Join(dir, "entry-1.tmp"), []byte("{"), 0o600)
+	NewCache(time.Minute, 2, dir)
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "c.json" {
+		t.Errorf("files after pruning = %v, want only c.json", files)
+	}
+}
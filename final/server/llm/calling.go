@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"server/config"
+	"server/tools"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+var ErrTooManyToolCalls = errors.New("too many tool calls")
+
+// declarations describes the session's tools to the model.
+func declarations(session *tools.Session) []*genai.Tool {
+	var functions []*genai.FunctionDeclaration
+	for _, tool := range session.Tools() {
+		schema := &genai.Schema{Type: genai.TypeObject, Properties: make(map[string]*genai.Schema)}
+		for _, p := range tool.Params {
+			kind := genai.TypeString
+			if p.Type == "number" {
+				kind = genai.TypeNumber
+			}
+			schema.Properties[p.Name] = &genai.Schema{Type: kind, Description: p.Description}
+			if p.Required {
+				schema.Required = append(schema.Required, p.Name)
+			}
+		}
+		functions = append(functions, &genai.FunctionDeclaration{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  schema,
+		})
+	}
+	return []*genai.Tool{{FunctionDeclarations: functions}}
+}
+
+// generateWithTools lets the model call the session's tools before it
+// answers: while it asks for calls, they are run and their results sent
+// back, up to config.ToolRounds times. The model gives one candidate, with
+// the calls that led to it.
+func generateWithTools(name string, model *genai.GenerativeModel, prompt string, session *tools.Session) ([]Candidate, Usage, error) {
+	usage := Usage{Model: name}
+	if model == nil {
+		return nil, usage, fmt.Errorf("%s: client not initialized", Provider)
+	}
+	withTools := *model
+	withTools.Tools = declarations(session)
+	// Only the first candidate's calls are followed, so ask for one.
+	withTools.SetCandidateCount(1)
+	chat := withTools.StartChat()
+
+	parts := []genai.Part{genai.Text(prompt)}
+	for round := 0; ; round++ {
+		resp, spent, err := call(name, prompt, func(ctx context.Context) (*genai.GenerateContentResponse, bool, error) {
+			// A failed message must not stay in the history for the retry.
+			sent := len(chat.History)
+			resp, err := chat.SendMessage(ctx, parts...)
+			if err != nil {
+				chat.History = chat.History[:sent]
+			}
+			return resp, false, err
+		})
+		usage.Requests += spent.Requests
+		usage.PromptTokens += spent.PromptTokens
+		usage.CompletionTokens += spent.CompletionTokens
+		if err != nil {
+			return nil, usage, err
+		}
+
+		calls := functionCalls(resp)
+		if len(calls) == 0 {
+			result, err := candidates(resp)
+			for i := range result {
+				result[i].Tools = session.Calls()
+			}
+			if err != nil {
+				return result, usage, fmt.Errorf("%s: %w", Provider, err)
+			}
+			return result, usage, nil
+		}
+		if round == config.ToolRounds {
+			return nil, usage, fmt.Errorf("%s: %w, %d rounds without an answer", Provider, ErrTooManyToolCalls, round+1)
+		}
+		parts = parts[:0]
+		for _, c := range calls {
+			made := session.Run(c.Name, c.Args)
+			fmt.Printf("Tool call %s\n", made)
+			parts = append(parts, genai.FunctionResponse{
+				Name:     c.Name,
+				Response: map[string]any{"result": made.Result},
+			})
+		}
+	}
+}
+
+// functionCalls returns the calls the first candidate asks for.
+func functionCalls(resp *genai.GenerateContentResponse) []genai.FunctionCall {
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return nil
+	}
+	var calls []genai.FunctionCall
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if c, ok := part.(genai.FunctionCall); ok {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
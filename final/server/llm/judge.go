@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"server/config"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// EmbeddingModel is used to compare answers by meaning.
+var EmbeddingModel = "text-embedding-004"
+
+var judgeNumber = regexp.MustCompile(`\d+`)
+
+// Judge asks the model which answer best answers the latest query in the
+// history and returns its index.
+func Judge(history string, answers []string) (int, Usage, error) {
+	var prompt strings.Builder
+	prompt.WriteString("You are judging answers to the latest query in this chat history:\n\n")
+	prompt.WriteString(history)
+	prompt.WriteString("\n\nCandidate answers:\n")
+	for i, answer := range answers {
+		fmt.Fprintf(&prompt, "%d. %s\n", i+1, answer)
+	}
+	prompt.WriteString("\nReply with only the number of the most accurate and helpful answer.")
+
+	candidates, usage, err := generate(modelName, JudgeModel, prompt.String(), nil)
+	if err != nil {
+		return 0, usage, err
+	}
+	for _, c := range candidates {
+		if !c.Usable() {
+			continue
+		}
+		n, err := strconv.Atoi(judgeNumber.FindString(c.Text))
+		if err != nil || n < 1 || n > len(answers) {
+			return 0, usage, fmt.Errorf("judge gave no valid answer number: %q", c.Text)
+		}
+		return n - 1, usage, nil
+	}
+	return 0, usage, errors.New("judge gave no answer")
+}
+
+// Embed returns an embedding vector for each text. The provider reports
+// no token counts for embeddings, so usage is estimated.
+func Embed(texts []string) ([][]float32, Usage, error) {
+	usage := Usage{Model: EmbeddingModel}
+	if Client == nil {
+		return nil, usage, fmt.Errorf("%s: client not initialized", Provider)
+	}
+	breaker := breakerFor(Provider, config.BreakerThreshold, config.BreakerCooldown)
+	// Wait for the rate limit first: Allow may take the breaker's only
+	// trial slot, which must be followed by a call and its Record.
+	if err := limit(); err != nil {
+		return nil, usage, err
+	}
+	if !breaker.Allow() {
+		return nil, usage, fmt.Errorf("%s: %w", Provider, ErrCircuitOpen)
+	}
+	usage.Requests++
+	ctx, cancel := context.WithTimeout(context.Background(), config.QueryTimeout)
+	defer cancel()
+	batch := Client.EmbeddingModel(EmbeddingModel).NewBatch()
+	for _, text := range texts {
+		batch.AddContent(genai.Text(text))
+	}
+	resp, err := Client.EmbeddingModel(EmbeddingModel).BatchEmbedContents(ctx, batch)
+	breaker.Record(err == nil || !retryable(err))
+	if err != nil {
+		return nil, usage, fmt.Errorf("%s: %w", Provider, redact(err))
+	}
+	for _, text := range texts {
+		usage.PromptTokens += CountTokens(text)
+	}
+	if len(resp.Embeddings) != len(texts) {
+		return nil, usage, fmt.Errorf("%s: %w: %d embeddings for %d texts", Provider, ErrEmpty, len(resp.Embeddings), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for i, e := range resp.Embeddings {
+		vectors[i] = e.Values
+	}
+	return vectors, usage, nil
+}
+
+func Cosine(a []float32, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		if i >= len(b) {
+			break
+		}
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"server/config"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// Bucket is a token bucket: it holds up to burst requests and refills at
+// rate per second. Waiting callers reserve their request, so they are let
+// through in turn.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+var (
+	buckets      = make(map[string]*Bucket)
+	bucketsMutex sync.Mutex
+)
+
+// bucketFor returns the bucket for the provider's API key, or nil when
+// there is no limit. perMinute is the sustained rate.
+func bucketFor(provider string, key string, perMinute int, burst int) *Bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(key))
+	name := provider + ":" + hex.EncodeToString(hash[:4])
+	bucketsMutex.Lock()
+	defer bucketsMutex.Unlock()
+	b, ok := buckets[name]
+	if !ok {
+		b = &Bucket{rate: float64(perMinute) / 60, burst: float64(max(burst, 1)), last: time.Now()}
+		b.tokens = b.burst
+		buckets[name] = b
+	}
+	return b
+}
+
+// Wait blocks until a request is allowed, or fails at once with
+// ErrRateLimited if that would take longer than limit.
+func (b *Bucket) Wait(limit time.Duration) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > limit {
+		b.mu.Unlock()
+		return fmt.Errorf("%w: next request allowed in %s", ErrRateLimited, wait.Round(time.Millisecond))
+	}
+	b.tokens--
+	b.mu.Unlock()
+	time.Sleep(wait)
+	return nil
+}
+
+// limit waits for the provider's rate limit, up to a query's timeout.
+func limit() error {
+	b := bucketFor(Provider, config.GeminiAPIKey, config.RateLimit, config.RateBurst)
+	if err := b.Wait(config.QueryTimeout); err != nil {
+		return fmt.Errorf("%s: %w", Provider, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package llm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	// Each step waits with limit and must fail with ErrRateLimited when
+	// limited is set; idle first lets that much time pass.
+	type step struct {
+		idle    time.Duration
+		limit   time.Duration
+		limited bool
+	}
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		steps     []step
+	}{
+		{"a burst goes through at once", 60, 3, []step{{0, 0, false}, {0, 0, false}, {0, 0, false}, {0, 0, true}}},
+		{"a burst of 0 is 1", 60, 0, []step{{0, 0, false}, {0, 0, true}}},
+		{"refills at the rate", 60, 1, []step{{0, 0, false}, {0, 0, true}, {time.Second, 0, false}, {0, 0, true}}},
+		{"never beyond the burst", 60, 2, []step{{time.Hour, 0, false}, {0, 0, false}, {0, 0, true}}},
+		{"waits within the limit", 600, 1, []step{{0, 0, false}, {0, time.Second, false}, {0, time.Millisecond, true}}},
+	}
+	for _, test := range tests {
+		b := bucketFor("test", test.name, test.perMinute, test.burst)
+		for i, s := range test.steps {
+			b.mu.Lock()
+			b.last = b.last.Add(-s.idle)
+			b.mu.Unlock()
+			err := b.Wait(s.limit)
+			if limited := errors.Is(err, ErrRateLimited); limited != s.limited || err != nil && !limited {
+				t.Errorf("%s: step %d: Wait(%s) = %v, want limited %t", test.name, i, s.limit, err, s.limited)
+			}
+		}
+	}
+}
+
+func TestBucketFor(t *testing.T) {
+	if b := bucketFor("test", "key", 0, 5); b != nil {
+		t.Errorf("bucketFor without a rate = %v, want nil", b)
+	}
+	var unlimited *Bucket
+	if err := unlimited.Wait(0); err != nil {
+		t.Errorf("Wait on a nil bucket = %v, want nil", err)
+	}
+	if bucketFor("test", "one", 60, 1) != bucketFor("test", "one", 60, 1) {
+		t.Error("the same key got two buckets")
+	}
+	if bucketFor("test", "one", 60, 1) == bucketFor("test", "two", 60, 1) {
+		t.Error("two keys share a bucket")
+	}
+}
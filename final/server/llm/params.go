@@ -0,0 +1,135 @@
+package llm
+
+import (
+	"fmt"
+	"server/tools"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Params are a context's model and generation settings. Unset fields keep
+// the defaults of the node's model.
+type Params struct {
+	Model       string
+	Temperature *float32
+	TopP        *float32
+	MaxTokens   *int32
+	System      string
+	// Tools lists the tools the model may call, comma separated.
+	Tools string
+}
+
+// ParseParams reads Params from a context's settings. model may list
+// several models separated by commas, to diversify candidates: node n of
+// the cluster, counting the leader as 0, uses the n-th, wrapping around.
+func ParseParams(settings map[string]string, node int) (Params, error) {
+	var p Params
+	if value, ok := settings["model"]; ok {
+		models := strings.Split(value, ",")
+		for _, m := range models {
+			if m == "" {
+				return p, fmt.Errorf("invalid model %q", value)
+			}
+		}
+		p.Model = models[node%len(models)]
+	}
+	if value, ok := settings["temperature"]; ok {
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil || f < 0 || f > 2 {
+			return p, fmt.Errorf("invalid temperature %q, want 0 to 2", value)
+		}
+		t := float32(f)
+		p.Temperature = &t
+	}
+	if value, ok := settings["top_p"]; ok {
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil || f <= 0 || f > 1 {
+			return p, fmt.Errorf("invalid top_p %q, want over 0 up to 1", value)
+		}
+		t := float32(f)
+		p.TopP = &t
+	}
+	if value, ok := settings["max_tokens"]; ok {
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("invalid max_tokens %q", value)
+		}
+		m := int32(n)
+		p.MaxTokens = &m
+	}
+	if value, ok := settings["tools"]; ok {
+		names, err := tools.Parse(value)
+		if err != nil {
+			return p, err
+		}
+		p.Tools = strings.Join(names, ",")
+	}
+	p.System = settings["system"]
+	return p, nil
+}
+
+// modelName is the model the params select on this node.
+func (p Params) modelName() string {
+	if p.Model != "" {
+		return p.Model
+	}
+	return modelName
+}
+
+// model returns a model configured with the params, based on the node's
+// default model.
+func (p Params) model() *genai.GenerativeModel {
+	if Model == nil {
+		return nil
+	}
+	if p == (Params{}) {
+		return Model
+	}
+	m := Model
+	if p.Model != "" {
+		m = Client.GenerativeModel(p.Model)
+		m.GenerationConfig = Model.GenerationConfig
+	} else {
+		copied := *Model
+		m = &copied
+	}
+	if p.Temperature != nil {
+		m.SetTemperature(*p.Temperature)
+	}
+	if p.TopP != nil {
+		m.SetTopP(*p.TopP)
+	}
+	if p.MaxTokens != nil {
+		m.SetMaxOutputTokens(*p.MaxTokens)
+	}
+	if p.System != "" {
+		m.SystemInstruction = genai.NewUserContent(genai.Text(p.System))
+	}
+	return m
+}
+
+// String describes the params for logs, leaving out unset ones.
+func (p Params) String() string {
+	var parts []string
+	if p.Model != "" {
+		parts = append(parts, "model="+p.Model)
+	}
+	if p.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temperature=%g", *p.Temperature))
+	}
+	if p.TopP != nil {
+		parts = append(parts, fmt.Sprintf("top_p=%g", *p.TopP))
+	}
+	if p.MaxTokens != nil {
+		parts = append(parts, fmt.Sprintf("max_tokens=%d", *p.MaxTokens))
+	}
+	if p.Tools != "" {
+		parts = append(parts, "tools="+p.Tools)
+	}
+	if p.System != "" {
+		parts = append(parts, fmt.Sprintf("system=%q", p.System))
+	}
+	return strings.Join(parts, " ")
+}
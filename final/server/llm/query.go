@@ -2,19 +2,42 @@ package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"server/config"
+	"server/tools"
+	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var Client *genai.Client
 var Model *genai.GenerativeModel
 
-var prefix = "You are given chat history in the form of Query: <query> and Answer: <answer>. Please answer the latest query and return a single line answer with no prefix.\n\n"
+// modelName is the node's default model, for cache keys.
+var modelName string
 
-func Initialize(modelName string) {
+// Responses caches answers by prompt, model and settings.
+var Responses *Cache
+
+// JudgeModel answers with a single candidate, for judging other answers
+// and summarizing history.
+var JudgeModel *genai.GenerativeModel
+
+// Provider names the backend for circuit breaking and error messages.
+var Provider = "gemini"
+
+var prefix = "You are given chat history in the form of Query: <query> and Answer: <answer>, which may start with a Summary: of earlier turns and include Tool: <tool> <arguments> -> <result> lines for tools called. It may be preceded by Documents: with passages labelled [<id>]; cite the id of any passage you use, like [guide.md#2]. Please answer the latest query and return a single line answer with no prefix.\n\n"
+
+func Initialize(name string) {
 	ctx := context.Background()
 	client, err := genai.NewClient(ctx, option.WithAPIKey(config.GeminiAPIKey))
 	if err != nil {
@@ -23,17 +46,224 @@ func Initialize(modelName string) {
 	}
 
 	Client = client
-	Model = client.GenerativeModel(modelName)
+	Model = client.GenerativeModel(name)
+	modelName = name
+	Responses = NewCache(config.CacheTTL, config.CacheSize, config.CacheDir)
+	if config.Candidates > 1 {
+		Model.SetCandidateCount(int32(config.Candidates))
+	}
+	JudgeModel = client.GenerativeModel(name)
 }
 
-func Query(query string) (string, error) {
-	// Generate content
-	ctx := context.Background()
-	resp, err := Model.GenerateContent(ctx, genai.Text(prefix+query))
+// Partial receives text as the model generates it, by candidate index.
+type Partial func(candidate int, text string)
+
+// Query asks the model to answer the latest query in the history and
+// returns its candidates, failing only if none has usable text. When
+// partial is not nil the response is streamed to it as it is generated.
+// params override the node's model and generation settings. Answers
+// to a prompt asked before with the same model and settings come from the
+// cache, marked as such, while they last. Answers that may call tools are
+// never cached, since what the tools return changes.
+// Each attempt has its own deadline, and attempts that fail for reasons
+// that may pass (rate limits, unavailability, timeouts) are retried with
+// jittered exponential backoff, unless the provider's circuit breaker is
+// open. A stream that breaks after text was passed on is not retried.
+// Calls wait their turn under the provider's rate limit, and what they used
+// is returned whether or not they succeeded. With a session that has tools
+// the model may call them first; the answer is then not streamed but
+// passed to partial whole.
+func Query(query string, params Params, session *tools.Session, partial Partial) ([]Candidate, Usage, error) {
+	prompt := prefix + query
+	name := params.modelName()
+	withTools := session != nil && len(session.Tools()) > 0
+	key := cacheKey(name, params, config.Candidates, prompt)
+	if cached, ok := Responses.Get(key); ok && !withTools {
+		if partial != nil {
+			for i, c := range cached {
+				if c.Text != "" {
+					partial(i, c.Text)
+				}
+			}
+		}
+		return cached, Usage{Model: name}, nil
+	}
+	var result []Candidate
+	var usage Usage
+	var err error
+	if withTools {
+		result, usage, err = generateWithTools(name, params.model(), prompt, session)
+		for i, c := range result {
+			if partial != nil && c.Text != "" {
+				partial(i, c.Text)
+			}
+		}
+	} else {
+		result, usage, err = generate(name, params.model(), prompt, partial)
+	}
+	if err == nil && !withTools {
+		Responses.Put(key, result)
+	}
+	return result, usage, err
+}
+
+// PromptTokens is how many tokens Query adds to the history.
+func PromptTokens() int {
+	return CountTokens(prefix)
+}
+
+// generate calls the model, retrying as Query describes, and returns what
+// the attempts used.
+func generate(name string, model *genai.GenerativeModel, prompt string, partial Partial) ([]Candidate, Usage, error) {
+	if model == nil {
+		return nil, Usage{Model: name}, fmt.Errorf("%s: client not initialized", Provider)
+	}
+	resp, usage, err := call(name, prompt, func(ctx context.Context) (*genai.GenerateContentResponse, bool, error) {
+		return queryOnce(ctx, model, prompt, partial)
+	})
 	if err != nil {
-		fmt.Printf("Error generating content: %v\n", err)
-		return "", err
+		return nil, usage, err
+	}
+	result, err := candidates(resp)
+	if err != nil {
+		return result, usage, fmt.Errorf("%s: %w", Provider, err)
+	}
+	return result, usage, nil
+}
+
+// attempt makes one call within ctx, reporting whether any text was
+// streamed.
+type attempt func(ctx context.Context) (*genai.GenerateContentResponse, bool, error)
+
+// call makes an attempt, and retries it as Query describes. prompt is for
+// estimating usage when the provider does not report it.
+func call(name string, prompt string, try attempt) (*genai.GenerateContentResponse, Usage, error) {
+	usage := Usage{Model: name}
+	breaker := breakerFor(Provider, config.BreakerThreshold, config.BreakerCooldown)
+	var err error
+	for attempt := 0; attempt <= config.QueryRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt))
+		}
+		// Wait for the rate limit first: Allow may take the breaker's only
+		// trial slot, which must be followed by a call and its Record.
+		if err := limit(); err != nil {
+			return nil, usage, err
+		}
+		if !breaker.Allow() {
+			return nil, usage, fmt.Errorf("%s: %w", Provider, ErrCircuitOpen)
+		}
+		usage.Requests++
+		var resp *genai.GenerateContentResponse
+		var streamed bool
+		ctx, cancel := context.WithTimeout(context.Background(), config.QueryTimeout)
+		resp, streamed, err = try(ctx)
+		cancel()
+		breaker.Record(err == nil || !retryable(err))
+		if err == nil {
+			spent := usageOf(name, prompt, resp)
+			usage.PromptTokens += spent.PromptTokens
+			usage.CompletionTokens += spent.CompletionTokens
+			return resp, usage, nil
+		}
+		var blocked *genai.BlockedError
+		if errors.As(err, &blocked) {
+			usage.PromptTokens += CountTokens(prompt)
+			return nil, usage, fmt.Errorf("%s: %w", Provider, blockedCandidate(blocked))
+		}
+		err = redact(err)
+		if !retryable(err) {
+			return nil, usage, fmt.Errorf("%s: %w", Provider, err)
+		}
+		if streamed {
+			return nil, usage, fmt.Errorf("%s: stream interrupted: %w", Provider, err)
+		}
+		fmt.Printf("Query attempt %d of %d failed: %v\n", attempt+1, config.QueryRetries+1, err)
+	}
+	return nil, usage, fmt.Errorf("%s: giving up after %d attempts: %w", Provider, config.QueryRetries+1, err)
+}
+
+// redactedError hides the API key, which REST errors include in the
+// request URL, from errors that are logged and sent to the leader.
+type redactedError struct {
+	err     error
+	message string
+}
+
+func (e *redactedError) Error() string { return e.message }
+func (e *redactedError) Unwrap() error { return e.err }
+
+func redact(err error) error {
+	if config.GeminiAPIKey == "" || !strings.Contains(err.Error(), config.GeminiAPIKey) {
+		return err
+	}
+	return &redactedError{err: err, message: strings.ReplaceAll(err.Error(), config.GeminiAPIKey, "REDACTED")}
+}
+
+// queryOnce makes one call, reporting whether any text was streamed.
+func queryOnce(ctx context.Context, model *genai.GenerativeModel, prompt string, partial Partial) (*genai.GenerateContentResponse, bool, error) {
+	if partial == nil {
+		resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+		return resp, false, err
 	}
 
-	return string(resp.Candidates[0].Content.Parts[0].(genai.Text)), nil
+	streamed := false
+	// The merged response keeps the first chunk's token counts, but the
+	// last chunk has the totals.
+	var usage *genai.UsageMetadata
+	iter := model.GenerateContentStream(ctx, genai.Text(prompt))
+	for {
+		chunk, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, streamed, err
+		}
+		if chunk.UsageMetadata != nil {
+			usage = chunk.UsageMetadata
+		}
+		for _, c := range chunk.Candidates {
+			if c.Content == nil {
+				continue
+			}
+			for _, part := range c.Content.Parts {
+				if text, ok := part.(genai.Text); ok && text != "" {
+					partial(int(c.Index), string(text))
+					streamed = true
+				}
+			}
+		}
+	}
+	if resp := iter.MergedResponse(); resp != nil {
+		resp.UsageMetadata = usage
+		return resp, streamed, nil
+	}
+	return &genai.GenerateContentResponse{}, streamed, nil
+}
+
+// backoff is 500ms doubled for every retry up to 8s, plus up to half again
+// of random jitter so the nodes do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	delay := 500 * time.Millisecond << (attempt - 1)
+	if delay > 8*time.Second {
+		delay = 8 * time.Second
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+func retryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var httpErr *googleapi.Error
+	if errors.As(err, &httpErr) {
+		return httpErr.Code == 429 || httpErr.Code >= 500
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Internal, codes.Aborted:
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
 }
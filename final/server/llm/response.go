@@ -0,0 +1,139 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"server/tools"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+var ErrBlocked = errors.New("blocked")
+var ErrEmpty = errors.New("empty response")
+var ErrTruncated = errors.New("truncated")
+
+// Candidate is one of the answers the model gave to a query. Err is nil for
+// a complete answer and wraps ErrTruncated for one cut off by the token
+// limit, whose Text is still usable. Candidates with no usable text have
+// Err wrapping ErrBlocked or ErrEmpty.
+type Candidate struct {
+	Text         string
+	FinishReason string
+	// Safety lists the ratings above negligible, like "Harassment:Medium".
+	Safety []string
+	Err    error
+	// Tools are the calls the model made before giving this answer.
+	Tools []tools.Call
+	// CachedAt is when the answer was cached, if it came from the cache
+	// instead of the model.
+	CachedAt time.Time
+}
+
+func (c Candidate) Usable() bool {
+	return c.Text != "" && (c.Err == nil || errors.Is(c.Err, ErrTruncated))
+}
+
+// Details describes anything unusual about the candidate for the operator
+// choosing between them, or returns "" for a normal answer.
+func (c Candidate) Details() string {
+	var details []string
+	if !c.CachedAt.IsZero() {
+		details = append(details, fmt.Sprintf("cached %s ago", time.Since(c.CachedAt).Round(time.Second)))
+	}
+	if c.Err != nil {
+		details = append(details, c.Err.Error())
+	} else if c.FinishReason != "" && c.FinishReason != "Stop" {
+		details = append(details, "finish "+c.FinishReason)
+	}
+	if len(c.Tools) > 0 {
+		details = append(details, fmt.Sprintf("%d tool calls", len(c.Tools)))
+	}
+	if len(c.Safety) > 0 {
+		details = append(details, "safety "+strings.Join(c.Safety, ","))
+	}
+	return strings.Join(details, "; ")
+}
+
+// candidates converts a response, concatenating the text parts of each
+// candidate. It fails only when no candidate has usable text.
+func candidates(resp *genai.GenerateContentResponse) ([]Candidate, error) {
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+		return nil, promptBlocked(resp.PromptFeedback)
+	}
+	if len(resp.Candidates) == 0 {
+		return nil, fmt.Errorf("%w: no candidates", ErrEmpty)
+	}
+
+	var result []Candidate
+	var firstErr error
+	for _, c := range resp.Candidates {
+		candidate := Candidate{
+			FinishReason: strings.TrimPrefix(c.FinishReason.String(), "FinishReason"),
+			Safety:       notableRatings(c.SafetyRatings),
+		}
+		if c.Content != nil {
+			var text strings.Builder
+			for _, part := range c.Content.Parts {
+				if t, ok := part.(genai.Text); ok {
+					text.WriteString(string(t))
+				}
+			}
+			candidate.Text = strings.TrimSpace(text.String())
+		}
+		switch {
+		case c.FinishReason == genai.FinishReasonSafety || c.FinishReason == genai.FinishReasonRecitation:
+			candidate.Text = ""
+			candidate.Err = fmt.Errorf("%w: %s", ErrBlocked, candidate.FinishReason)
+		case candidate.Text == "":
+			candidate.Err = fmt.Errorf("%w: finish %s", ErrEmpty, candidate.FinishReason)
+		case c.FinishReason == genai.FinishReasonMaxTokens:
+			candidate.Err = fmt.Errorf("%w at the token limit", ErrTruncated)
+		}
+		if !candidate.Usable() && firstErr == nil {
+			firstErr = candidate.Err
+		}
+		result = append(result, candidate)
+	}
+	for _, c := range result {
+		if c.Usable() {
+			return result, nil
+		}
+	}
+	return result, firstErr
+}
+
+// blockedCandidate converts the SDK's error for a blocked prompt or
+// candidate. The SDK drops the whole response when any candidate is blocked.
+func blockedCandidate(err *genai.BlockedError) error {
+	if err.PromptFeedback != nil {
+		return promptBlocked(err.PromptFeedback)
+	}
+	reason := strings.TrimPrefix(err.Candidate.FinishReason.String(), "FinishReason")
+	if ratings := notableRatings(err.Candidate.SafetyRatings); len(ratings) > 0 {
+		return fmt.Errorf("%w: %s (%s)", ErrBlocked, reason, strings.Join(ratings, ","))
+	}
+	return fmt.Errorf("%w: %s", ErrBlocked, reason)
+}
+
+func promptBlocked(feedback *genai.PromptFeedback) error {
+	reason := strings.TrimPrefix(feedback.BlockReason.String(), "BlockReason")
+	if ratings := notableRatings(feedback.SafetyRatings); len(ratings) > 0 {
+		return fmt.Errorf("%w: prompt %s (%s)", ErrBlocked, reason, strings.Join(ratings, ","))
+	}
+	return fmt.Errorf("%w: prompt %s", ErrBlocked, reason)
+}
+
+func notableRatings(ratings []*genai.SafetyRating) []string {
+	var notable []string
+	for _, r := range ratings {
+		if r == nil || r.Probability <= genai.HarmProbabilityNegligible && !r.Blocked {
+			continue
+		}
+		category := strings.TrimPrefix(r.Category.String(), "HarmCategory")
+		probability := strings.TrimPrefix(r.Probability.String(), "HarmProbability")
+		notable = append(notable, category+":"+probability)
+	}
+	return notable
+}
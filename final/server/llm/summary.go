@@ -0,0 +1,26 @@
+package llm
+
+import (
+	"errors"
+	"strings"
+)
+
+// Summarize condenses chat history into a short note that keeps the facts,
+// names and decisions later queries may refer to.
+func Summarize(history string) (string, Usage, error) {
+	var prompt strings.Builder
+	prompt.WriteString("Summarize this chat history of queries and answers in a single paragraph. ")
+	prompt.WriteString("Keep every fact, name, number and decision a later query could refer to, and nothing else.\n\n")
+	prompt.WriteString(history)
+
+	candidates, usage, err := generate(modelName, JudgeModel, prompt.String(), nil)
+	if err != nil {
+		return "", usage, err
+	}
+	for _, c := range candidates {
+		if c.Usable() {
+			return strings.Join(strings.Fields(c.Text), " "), usage, nil
+		}
+	}
+	return "", usage, errors.New("summary gave no text")
+}
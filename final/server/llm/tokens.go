@@ -0,0 +1,55 @@
+package llm
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Counter estimates how many tokens a provider's models see in text.
+type Counter func(text string) int
+
+// Counters are by provider. They are local estimates, not calls to the
+// provider's token counting API, so they cost nothing and every replica
+// fits a history to exactly the same prompt.
+var Counters = map[string]Counter{
+	"gemini": countGemini,
+}
+
+// CountTokens estimates the tokens in text for the current provider.
+func CountTokens(text string) int {
+	if counter, ok := Counters[Provider]; ok {
+		return counter(text)
+	}
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// countGemini follows Google's rule of thumb of about four characters
+// per token for English, but counts each word and punctuation mark as at
+// least one, and each character of scripts without spaces, like Chinese,
+// as one.
+func countGemini(text string) int {
+	tokens := 0
+	word := 0
+	flush := func() {
+		if word > 0 {
+			tokens += (word + 3) / 4
+			word = 0
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word++
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
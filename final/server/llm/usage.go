@@ -0,0 +1,37 @@
+package llm
+
+import "github.com/google/generative-ai-go/genai"
+
+// Usage is what calls to the model consumed.
+type Usage struct {
+	Model            string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// usageOf reads the provider's token counts from a response, estimating
+// them when it gave none.
+func usageOf(model string, prompt string, resp *genai.GenerateContentResponse) Usage {
+	u := Usage{Model: model, Requests: 1}
+	if resp != nil && resp.UsageMetadata != nil && resp.UsageMetadata.TotalTokenCount > 0 {
+		u.PromptTokens = int(resp.UsageMetadata.PromptTokenCount)
+		u.CompletionTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+		return u
+	}
+	u.PromptTokens = CountTokens(prompt)
+	if resp == nil {
+		return u
+	}
+	for _, c := range resp.Candidates {
+		if c.Content == nil {
+			continue
+		}
+		for _, part := range c.Content.Parts {
+			if text, ok := part.(genai.Text); ok {
+				u.CompletionTokens += CountTokens(string(text))
+			}
+		}
+	}
+	return u
+}
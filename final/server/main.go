@@ -1,27 +1,43 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"server/config"
 	"server/consensus"
 	"server/database"
 	"server/llm"
+	"server/rag"
+	"server/selection"
+	"server/stream"
+	"server/tools"
+	"server/usage"
+	"server/window"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func main() {
 	config.Validate()
+	if !window.Valid(config.ContextPolicy) {
+		panic(fmt.Sprintf("LLM_CONTEXT_POLICY %q is not window, drop or summarize", config.ContextPolicy))
+	}
 	database.Initialize()
-	llm.Initialize("gemini-1.5-flash")
+	llm.Initialize(config.Model)
+	rag.Initialize()
 
 	StartServer()
 }
 
 func StartServer() {
+	http.HandleFunc("/events", handleEvents)
 	http.HandleFunc("/", handleMessage)
 
 	fmt.Printf("Server %s is listening on port %s\n", config.Port, config.Port)
@@ -44,58 +60,189 @@ func handleMessage(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(message, "create") {
 		id := strings.Split(message, " ")[1]
 		if config.IsLeader {
-			consensus.PrepareProposal(fmt.Sprintf("create-%s", id), id)
+			settings, err := ParseContextSettings(strings.TrimPrefix(strings.TrimPrefix(message, "create "+id), " "))
+			if err != nil {
+				fmt.Printf("Cannot create %s: %v\n", id, err)
+				return
+			}
+			consensus.PrepareProposal(fmt.Sprintf("create-%s", id), strings.TrimSpace(fmt.Sprintf("%s %s", id, settings)))
 			database.CreateContext(id)
-			fmt.Printf("NEW CONTEXT %s\n", id)
-			for _, peer := range []string{"7001", "7002"} {
-				SendMessage(peer, fmt.Sprintf("accept-create %s", id))
+			database.SetSettings(id, settings)
+			fmt.Printf("NEW CONTEXT %s %s\n", id, settings)
+			for _, peer := range config.Followers {
+				SendMessage(peer, fmt.Sprintf("accept-create %s %s", id, settings))
 			}
 		}
 	}
 	if strings.HasPrefix(message, "query") {
 		id := strings.Split(message, " ")[1]
 		query := strings.TrimPrefix(message, "query "+id+" ")
-		eq := database.Get(id)
-		database.Set(id, fmt.Sprintf("%s\nQuery: %s", eq, query))
-		q := database.Get(id)
+		q := database.Append(id, fmt.Sprintf("\nQuery: %s", query))
 		fmt.Printf("NEW QUERY on %s with %s\n", id, q)
-		response, err := llm.Query(q)
+		stream.Publish(stream.Event{Type: "query", Context: id, Text: query})
+		var seq int
+		if config.IsLeader {
+			seq = BeginRound(id, q)
+		} else {
+			seq = database.NextQuery(id)
+		}
+		var partial llm.Partial
+		var forward *partials
+		if config.Stream && config.IsLeader {
+			partial = func(index int, text string) {
+				stream.Publish(stream.Event{Type: "partial", Context: id, Candidate: CandidateID(index), Text: text})
+			}
+		} else if config.Stream {
+			forward = forwardPartials(id)
+			defer forward.Close()
+			partial = forward.Add
+		}
+		settings := database.GetSettings(id)
+		var documents []rag.Result
+		if k, _ := strconv.Atoi(settings["rag"]); k > 0 {
+			results, spent, err := rag.Retrieve(query, k)
+			RecordUsage(id, spent)
+			if err != nil {
+				fmt.Printf("(%s) Cannot retrieve documents, answering without: %v\n", id, err)
+			}
+			documents = results
+		}
+		sources := rag.Prompt(documents)
+		prompt := window.Fit(q, ContextPolicy(settings), ContextBudget(settings)-llm.CountTokens(sources))
+		if prompt != q {
+			fmt.Printf("(%s) History cut from %d to %d tokens\n", id, llm.CountTokens(q), llm.CountTokens(prompt))
+		}
+		params, err := llm.ParseParams(settings, config.NodeIndex())
 		if err != nil {
-			println("error querying", err)
+			fmt.Printf("(%s) Bad model settings, using defaults: %v\n", id, err)
+			params = llm.Params{}
+		} else if params != (llm.Params{}) {
+			fmt.Printf("(%s) Querying with %s\n", id, params)
+		}
+		if err := usage.Check(config.Port, id); err != nil {
+			ReportFailure(id, seq, config.Port, config.Candidates, err.Error())
 			return
 		}
+		var session *tools.Session
+		if params.Tools != "" {
+			names, _ := tools.Parse(params.Tools)
+			session = tools.NewSession(names)
+		}
+		if sources != "" {
+			fmt.Printf("(%s) Retrieved%s\n", id, strings.TrimPrefix(rag.Turn(documents), "\nSources:"))
+			prompt = sources + prompt
+		}
+		candidates, spent, err := llm.Query(prompt, params, session, partial)
+		// Every partial goes out before the responses that end them.
+		forward.Close()
+		RecordUsage(id, spent)
+		if len(candidates) > 0 && !candidates[0].CachedAt.IsZero() {
+			fmt.Printf("(%s) Answered from cache\n", id)
+		}
+		if err != nil && len(candidates) == 0 {
+			ReportFailure(id, seq, config.Port, config.Candidates, err.Error())
+			return
+		}
+		for i, candidate := range candidates {
+			candidateID := CandidateID(i)
+			if !candidate.Usable() {
+				ReportFailure(id, seq, candidateID, 1, candidate.Err.Error())
+				continue
+			}
+			turns := rag.Turn(documents) + tools.Turns(candidate.Tools)
+			if config.IsLeader {
+				RecordResponse(id, seq, candidateID, candidate.Text, candidate.Details(), turns)
+			} else {
+				SendReliably(fmt.Sprintf("%d", config.LeaderPort), fmt.Sprintf("response %s %d %s %s %s %s",
+					id, seq, candidateID, escape(candidate.Details()), escape(turns), candidate.Text))
+			}
+		}
+		if missing := config.Candidates - len(candidates); missing > 0 {
+			// Tool calls ask for one candidate, so the round must not
+			// wait on the others.
+			ReportFailure(id, seq, CandidateID(len(candidates)), missing, "not generated")
+		}
+	}
+	if strings.HasPrefix(message, "partial") {
 		if config.IsLeader {
-			database.Responses[config.Port] = response
-			fmt.Printf("(%s) Response %s: %s\n", id, config.Port, response)
-		} else {
-			SendMessage(fmt.Sprintf("%d", config.LeaderPort), fmt.Sprintf("response %s %s %s", id, config.Port, response))
+			// partial <id> <candidate> <text>, with the text exactly as
+			// generated, spaces included.
+			parts := strings.SplitN(message, " ", 4)
+			if len(parts) == 4 {
+				stream.Publish(stream.Event{Type: "partial", Context: parts[1], Candidate: parts[2], Text: parts[3]})
+			}
 		}
 	}
 	if strings.HasPrefix(message, "response") {
 		if config.IsLeader {
-			id := strings.Split(message, " ")[1]
-			port := strings.Split(message, " ")[2]
-			response := strings.TrimPrefix(message, "response "+id+" "+port+" ")
-			database.Responses[port] = response
-			fmt.Printf("(%s) Response %s: %s\n", id, port, response)
+			// response <id> <query number> <candidate> <details> <turns>
+			// <text>, where details and turns are escaped.
+			parts := strings.SplitN(message, " ", 7)
+			if len(parts) < 6 {
+				return
+			}
+			seq, _ := strconv.Atoi(parts[2])
+			response := ""
+			if len(parts) == 7 {
+				response = parts[6]
+			}
+			RecordResponse(parts[1], seq, parts[3], response, unescape(parts[4]), unescape(parts[5]))
+		}
+	}
+	if strings.HasPrefix(message, "error") {
+		if config.IsLeader {
+			// error <id> <query number> <candidate> <count> <reason>,
+			// where count is how many candidates failed: all of a
+			// node's when the node could not answer at all.
+			parts := strings.SplitN(message, " ", 6)
+			if len(parts) < 6 {
+				return
+			}
+			id, port, reason := parts[1], parts[3], parts[5]
+			seq, _ := strconv.Atoi(parts[2])
+			count, _ := strconv.Atoi(parts[4])
+			fmt.Printf("(%s) Node %s failed: %s\n", id, port, reason)
+			RecordFailure(id, seq, port, max(count, 1), reason)
 		}
 	}
 	if strings.HasPrefix(message, "choose") {
 		id := strings.Split(message, " ")[1]
 		port := strings.Split(message, " ")[2]
-		response := database.Responses[port]
 		if config.IsLeader {
-			consensus.PrepareProposal(fmt.Sprintf("choose-%s", id), response)
-			database.ResetResponses()
-			eq := database.Get(id)
-			database.Set(id, fmt.Sprintf("%s\nAnswer: %s", eq, response))
-			fmt.Printf("CHOSEN ANSWER on %s with %s\n", id, response)
-			for _, peer := range []string{"7001", "7002"} {
-				SendMessage(peer, fmt.Sprintf("accept-choose %s %s", id, response))
+			Choose(id, port)
+		}
+	}
+	if strings.HasPrefix(message, "spent") {
+		if config.IsLeader {
+			// spent <id> <node> <model> <requests> <prompt tokens> <completion tokens>
+			parts := strings.Split(message, " ")
+			if len(parts) == 7 {
+				u := llm.Usage{Model: parts[3]}
+				u.Requests, _ = strconv.Atoi(parts[4])
+				u.PromptTokens, _ = strconv.Atoi(parts[5])
+				u.CompletionTokens, _ = strconv.Atoi(parts[6])
+				usage.Record(parts[2], parts[1], u)
 			}
-			database.PrintContext(id)
 		}
 	}
+	if strings.HasPrefix(message, "ingest") {
+		path := strings.TrimSpace(strings.TrimPrefix(message, "ingest"))
+		added, err := rag.Ingest(path)
+		if err != nil {
+			fmt.Printf("Cannot ingest %s: %v\n", path, err)
+		}
+		fmt.Printf("INGESTED %s: %d new chunks, %d in all\n", path, added, rag.Size())
+		return
+	}
+	if strings.HasPrefix(message, "usage") {
+		id := strings.TrimSpace(strings.TrimPrefix(message, "usage"))
+		if id == "" {
+			fmt.Printf("-------- USAGE on %s --------\n%s\n", config.Port, usage.Report(id))
+		} else {
+			fmt.Printf("-------- USAGE of %s on %s --------\n%s\n", id, config.Port, usage.Report(id))
+		}
+		return
+	}
 	if strings.HasPrefix(message, "viewall") {
 		database.PrintContexts()
 		return
@@ -107,17 +254,43 @@ func handleMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	if strings.HasPrefix(message, "accept-create") {
 		id := strings.Split(message, " ")[1]
+		settings, err := database.ParseSettings(strings.TrimPrefix(message, "accept-create "+id))
+		if err != nil {
+			fmt.Printf("Bad settings for %s, using defaults: %v\n", id, err)
+		}
 		database.CreateContext(id)
-		fmt.Printf("NEW CONTEXT %s\n", id)
+		database.SetSettings(id, settings)
+		fmt.Printf("NEW CONTEXT %s %s\n", id, settings)
 		fmt.Println("ACK")
 	}
+	if strings.HasPrefix(message, "accept-summary") {
+		// accept-summary <id> <turns> <summary>
+		parts := strings.SplitN(message, " ", 4)
+		if len(parts) == 4 {
+			id := parts[1]
+			count, _ := strconv.Atoi(parts[2])
+			database.Update(id, func(history string) string {
+				return window.Replace(history, count, parts[3])
+			})
+			fmt.Printf("SUMMARY on %s of %d turns: %s\n", id, count, parts[3])
+			fmt.Println("ACK")
+		}
+	}
 	if strings.HasPrefix(message, "accept-choose") {
-		parts := strings.Split(message, " ")
+		// accept-choose <id> <tool turns> <response>, with the tool
+		// turns escaped.
+		parts := strings.SplitN(message, " ", 4)
+		if len(parts) < 3 {
+			return
+		}
 		id := parts[1]
-		response := strings.Join(parts[2:], " ")
+		turns := unescape(parts[2])
+		response := ""
+		if len(parts) == 4 {
+			response = parts[3]
+		}
 		database.ResetResponses()
-		eq := database.Get(id)
-		database.Set(id, fmt.Sprintf("%s\nAnswer: %s", eq, response))
+		database.Append(id, fmt.Sprintf("%s\nAnswer: %s", turns, response))
 		fmt.Printf("CHOSEN ANSWER on %s with %s\n", id, response)
 		fmt.Println("ACK")
 	}
@@ -142,6 +315,322 @@ func handleMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Choose commits a candidate as the answer to the context's latest query,
+// whether the operator or a selection policy chose it.
+func Choose(id string, candidateID string) {
+	if reason, failed := database.GetFailure(candidateID); failed {
+		fmt.Printf("Cannot choose %s on %s, it failed: %s\n", candidateID, id, reason)
+		return
+	}
+	selection.End(id)
+	response, turns := database.GetResponse(candidateID)
+	// The documents and tool calls behind the answer are committed with
+	// it, so every replica records the same sources and tool results.
+	consensus.PrepareProposal(fmt.Sprintf("choose-%s", id), fmt.Sprintf("%s\nAnswer: %s", turns, response))
+	database.ResetResponses()
+	stream.Publish(stream.Event{Type: "chosen", Context: id, Candidate: candidateID, Text: response})
+	database.Append(id, fmt.Sprintf("%s\nAnswer: %s", turns, response))
+	fmt.Printf("CHOSEN ANSWER on %s with %s\n", id, response)
+	for _, peer := range config.Followers {
+		SendMessage(peer, fmt.Sprintf("accept-choose %s %s %s", id, escape(turns), response))
+	}
+	database.PrintContext(id)
+	if ContextPolicy(database.GetSettings(id)) == window.Summarize {
+		go Compact(id)
+	}
+}
+
+// compacting holds the contexts being summarized, so a summary is not
+// planned again before the last one replaced the turns it covers.
+var compacting sync.Map
+
+// Compact summarizes a context's older turns once its history is over
+// budget and commits the summary, which every replica then puts in place of
+// those turns.
+func Compact(id string) {
+	if _, busy := compacting.LoadOrStore(id, true); busy {
+		return
+	}
+	defer compacting.Delete(id)
+
+	count, older := window.Plan(database.Get(id), ContextBudget(database.GetSettings(id)))
+	if count == 0 {
+		return
+	}
+	fmt.Printf("(%s) Summarizing %d turns\n", id, count)
+	if err := usage.Check(config.Port, id); err != nil {
+		fmt.Printf("(%s) Cannot summarize, dropping old turns instead: %v\n", id, err)
+		return
+	}
+	summary, spent, err := llm.Summarize(older)
+	RecordUsage(id, spent)
+	if err != nil {
+		fmt.Printf("(%s) Cannot summarize, dropping old turns instead: %v\n", id, err)
+		return
+	}
+	consensus.PrepareProposal(fmt.Sprintf("summary-%s", id), summary)
+	database.Update(id, func(history string) string {
+		return window.Replace(history, count, summary)
+	})
+	fmt.Printf("SUMMARY on %s of %d turns: %s\n", id, count, summary)
+	for _, peer := range config.Followers {
+		SendMessage(peer, fmt.Sprintf("accept-summary %s %d %s", id, count, summary))
+	}
+	database.PrintContext(id)
+}
+
+// ContextPolicy is how a context keeps its history within budget.
+func ContextPolicy(settings database.Settings) string {
+	if policy, ok := settings["context"]; ok {
+		return policy
+	}
+	return config.ContextPolicy
+}
+
+// ContextBudget is how many tokens of history a context's queries may
+// send.
+func ContextBudget(settings database.Settings) int {
+	tokens := config.ContextTokens
+	if n, err := strconv.Atoi(settings["context_tokens"]); err == nil {
+		tokens = n
+	}
+	return tokens - llm.PromptTokens()
+}
+
+// ParseContextSettings parses and checks the options given to create.
+func ParseContextSettings(text string) (database.Settings, error) {
+	settings, err := database.ParseSettings(text)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range settings {
+		switch key {
+		case "policy":
+			if !selection.Valid(value) {
+				return nil, fmt.Errorf("unknown policy %q", value)
+			}
+		case "timeout":
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q", value)
+			}
+		case "model", "temperature", "top_p", "max_tokens", "system", "tools":
+			// Checked by llm.ParseParams below.
+		case "seed":
+			// Rejected rather than stored, since nothing would use it.
+			return nil, fmt.Errorf("seed is not supported: the Gemini client cannot send one")
+		case "rag":
+			if k, err := strconv.Atoi(value); err != nil || k < 0 || k > 20 {
+				return nil, fmt.Errorf("invalid rag %q, want up to 20 documents", value)
+			}
+		case "context":
+			if !window.Valid(value) {
+				return nil, fmt.Errorf("unknown context policy %q", value)
+			}
+		case "context_tokens":
+			if n, err := strconv.Atoi(value); err != nil || n <= llm.PromptTokens() {
+				return nil, fmt.Errorf("invalid context_tokens %q", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if _, err := llm.ParseParams(settings, 0); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// CandidateID names this node's candidates: the first by its port and any
+// others by "<port>.<n>", which is what choose takes.
+func CandidateID(index int) string {
+	if index == 0 {
+		return config.Port
+	}
+	return fmt.Sprintf("%s.%d", config.Port, index+1)
+}
+
+// RecordResponse adds a candidate to the list the operator chooses from,
+// with the documents and tool calls that led to it as history turns.
+func RecordResponse(id string, seq int, candidateID string, response string, details string, turns string) {
+	if holdEarly(id, seq, func() { RecordResponse(id, seq, candidateID, response, details, turns) }) {
+		return
+	}
+	if !current(id, seq) {
+		fmt.Printf("(%s) Dropping response %s to earlier query %d\n", id, candidateID, seq)
+		return
+	}
+	database.SetResponse(candidateID, response, details, turns)
+	if turns != "" {
+		fmt.Printf("(%s) Turns for %s:%s\n", id, candidateID, turns)
+	}
+	selection.Add(id, seq, selection.Candidate{ID: candidateID, Text: response})
+	stream.Publish(stream.Event{Type: "response", Context: id, Candidate: candidateID, Text: response, Details: details})
+	if details != "" {
+		fmt.Printf("(%s) Response %s: %s [%s]\n", id, candidateID, response, details)
+		return
+	}
+	fmt.Printf("(%s) Response %s: %s\n", id, candidateID, response)
+}
+
+// RecordUsage accounts for what this node used for a context. Followers
+// tell the leader, so it has the totals of every node.
+func RecordUsage(id string, spent llm.Usage) {
+	if spent.Requests == 0 {
+		return
+	}
+	usage.Record(config.Port, id, spent)
+	if !config.IsLeader {
+		SendMessage(fmt.Sprintf("%d", config.LeaderPort), fmt.Sprintf("spent %s %s %s %d %d %d",
+			id, config.Port, spent.Model, spent.Requests, spent.PromptTokens, spent.CompletionTokens))
+	}
+}
+
+// escape makes text safe as one field of a message, and "-" when empty.
+func escape(text string) string {
+	if text == "" {
+		return "-"
+	}
+	return url.QueryEscape(text)
+}
+
+func unescape(field string) string {
+	if field == "-" {
+		return ""
+	}
+	text, _ := url.QueryUnescape(field)
+	return text
+}
+
+// ReportFailure records why count candidates have no answer: one, or all
+// of this node's when it could not query at all. Followers tell the
+// leader, so it can report the node as failed instead of waiting on a
+// response that will never come.
+func ReportFailure(id string, seq int, candidateID string, count int, reason string) {
+	reason = strings.ReplaceAll(reason, "\n", " ")
+	fmt.Printf("(%s) Query failed on %s: %s\n", id, candidateID, reason)
+	if config.IsLeader {
+		RecordFailure(id, seq, candidateID, count, reason)
+	} else {
+		SendReliably(fmt.Sprintf("%d", config.LeaderPort), fmt.Sprintf("error %s %d %s %d %s", id, seq, candidateID, count, reason))
+	}
+}
+
+// RecordFailure counts count candidates of query seq as failed on the
+// leader.
+func RecordFailure(id string, seq int, candidateID string, count int, reason string) {
+	if holdEarly(id, seq, func() { RecordFailure(id, seq, candidateID, count, reason) }) {
+		return
+	}
+	if !current(id, seq) {
+		fmt.Printf("(%s) Dropping failure of %s for earlier query %d\n", id, candidateID, seq)
+		return
+	}
+	database.SetFailure(candidateID, reason)
+	stream.Publish(stream.Event{Type: "failure", Context: id, Candidate: candidateID, Text: reason})
+	selection.Fail(id, seq, count)
+}
+
+// current reports whether seq numbers the query a context is waiting on.
+// A node that answers after the next query has started would otherwise be
+// counted as a candidate for it.
+func current(id string, seq int) bool {
+	return seq == database.CurrentQuery(id)
+}
+
+// early holds what followers reported for a query the leader has not
+// started yet. Every node gets the query at about the same time, so a
+// follower's first candidates can beat the leader's own NextQuery.
+var (
+	early      = make(map[string][]earlyReport)
+	earlyMutex sync.Mutex
+)
+
+type earlyReport struct {
+	seq    int
+	record func()
+}
+
+// BeginRound numbers a new query on the leader and starts selecting among
+// its candidates, then records whatever followers already sent for it.
+func BeginRound(id string, history string) int {
+	settings := database.GetSettings(id)
+	timeout, _ := time.ParseDuration(settings["timeout"])
+	if timeout <= 0 {
+		timeout = config.SelectionTimeout
+	}
+	expected := (1 + len(config.Followers)) * config.Candidates
+
+	earlyMutex.Lock()
+	seq := database.NextQuery(id)
+	selection.Begin(id, seq, settings["policy"], history, expected, timeout, func(candidateID string) {
+		Choose(id, candidateID)
+	})
+	var ready, later []earlyReport
+	for _, report := range early[id] {
+		if report.seq == seq {
+			ready = append(ready, report)
+		} else if report.seq > seq {
+			later = append(later, report)
+		}
+	}
+	early[id] = later
+	earlyMutex.Unlock()
+
+	for _, report := range ready {
+		report.record()
+	}
+	return seq
+}
+
+// holdEarly keeps record for when the leader starts query seq, if it has
+// not yet, and reports whether it did. The round is begun under the same
+// lock, so a report let through always finds it.
+func holdEarly(id string, seq int, record func()) bool {
+	earlyMutex.Lock()
+	defer earlyMutex.Unlock()
+	if seq <= database.CurrentQuery(id) {
+		return false
+	}
+	early[id] = append(early[id], earlyReport{seq: seq, record: record})
+	return true
+}
+
+// handleEvents streams a context's candidates to an operator as
+// Server-Sent Events while they are generated: GET /events?id=<context>,
+// or without id for every context. Only the leader sees every node's
+// candidates.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	events, cancel := stream.Subscribe(r.URL.Query().Get("id"))
+	defer cancel()
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
 func SendMessage(dest string, message string) error {
 	resp, err := http.Post(
 		fmt.Sprintf("http://localhost:%s", config.ProxyPort),
@@ -152,9 +641,104 @@ func SendMessage(dest string, message string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sending to %s: %s", dest, resp.Status)
+	}
 	return nil
 }
 
+// SendReliably retries a message that must not be lost, like a candidate
+// or its failure, which the leader would otherwise wait on until the
+// selection timeout.
+func SendReliably(dest string, message string) error {
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = SendMessage(dest, message); err == nil {
+			return nil
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	fmt.Printf("Giving up sending to %s: %v\n", dest, err)
+	return err
+}
+
+// partials forwards a follower's streamed text to the leader off the
+// model's receive loop. Text that arrives while a send is in flight is
+// batched by candidate into the next one, so at most one message per
+// candidate waits and a slow leader costs messages, never text or
+// generation time.
+type partials struct {
+	id      string
+	mu      sync.Mutex
+	pending map[int]string
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func forwardPartials(id string) *partials {
+	p := &partials{
+		id:      id,
+		pending: make(map[int]string),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Add queues text for a candidate without waiting on the network.
+func (p *partials) Add(index int, text string) {
+	p.mu.Lock()
+	p.pending[index] += text
+	p.mu.Unlock()
+	p.signal()
+}
+
+// Close sends what is still queued and waits for it. It may be called more
+// than once, and on nil.
+func (p *partials) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.signal()
+	<-p.done
+}
+
+func (p *partials) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *partials) run() {
+	defer close(p.done)
+	leader := fmt.Sprintf("%d", config.LeaderPort)
+	for range p.wake {
+		p.mu.Lock()
+		pending, closed := p.pending, p.closed
+		p.pending = make(map[int]string)
+		p.mu.Unlock()
+		indexes := make([]int, 0, len(pending))
+		for index := range pending {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		for _, index := range indexes {
+			SendMessage(leader, fmt.Sprintf("partial %s %s %s", p.id, CandidateID(index), pending[index]))
+		}
+		if closed {
+			return
+		}
+	}
+}
+
 func FailNode() {
 	println("Received fail node message")
 	os.Exit(1)
@@ -0,0 +1,52 @@
+package rag
+
+import (
+	"fmt"
+	"strings"
+)
+
+// split cuts a document into chunks of about size words, overlapping by
+// overlap words so a passage cut in two is still found whole in one of
+// them. Chunks end at paragraph breaks where they can. overlap must be
+// less than size.
+func split(text string, size int, overlap int) []string {
+	var paragraphs [][]string
+	for _, p := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if words := strings.Fields(p); len(words) > 0 {
+			paragraphs = append(paragraphs, words)
+		}
+	}
+
+	var chunks []string
+	var current []string
+	// fresh counts the words in current that no chunk has yet.
+	fresh := 0
+	flush := func() {
+		chunks = append(chunks, strings.Join(current, " "))
+		current = append([]string(nil), current[max(len(current)-overlap, 0):]...)
+		fresh = 0
+	}
+	for _, words := range paragraphs {
+		if fresh > 0 && len(current)+len(words) > size {
+			flush()
+		}
+		for len(words) > 0 {
+			if len(current) >= size {
+				flush()
+			}
+			take := min(size-len(current), len(words))
+			current = append(current, words[:take]...)
+			words = words[take:]
+			fresh += take
+		}
+	}
+	if fresh > 0 {
+		flush()
+	}
+	return chunks
+}
+
+// chunkID names the n-th chunk of a document, counting from 1.
+func chunkID(source string, n int) string {
+	return fmt.Sprintf("%s#%d", source, n)
+}
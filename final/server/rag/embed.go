@@ -0,0 +1,79 @@
+package rag
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"server/llm"
+	"strings"
+	"unicode"
+)
+
+// Embedder returns a vector for each text, and what calling the model for
+// them used, if anything.
+type Embedder func(texts []string) ([][]float32, llm.Usage, error)
+
+var Embedders = map[string]Embedder{
+	"hash":   HashEmbed,
+	"gemini": llm.Embed,
+}
+
+// hashDimensions is the length of HashEmbed's vectors.
+const hashDimensions = 512
+
+// HashEmbed embeds text locally and deterministically by hashing its words
+// and pairs of adjacent words into a fixed number of dimensions. It finds
+// chunks sharing words with the query rather than meaning, but needs no
+// model, and every node computes exactly the same vectors.
+func HashEmbed(texts []string) ([][]float32, llm.Usage, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, hashDimensions)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for j, word := range words {
+			add(vector, word, 1)
+			if j > 0 {
+				add(vector, words[j-1]+" "+word, 0.5)
+			}
+		}
+		normalize(vector)
+		vectors[i] = vector
+	}
+	return vectors, llm.Usage{}, nil
+}
+
+// add hashes a feature to a dimension and a sign, so that collisions
+// cancel out rather than pile up.
+func add(vector []float32, feature string, weight float32) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[sum%uint64(len(vector))] += weight
+}
+
+func normalize(vector []float32) {
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range vector {
+		vector[i] *= scale
+	}
+}
+
+func embedder(name string) (Embedder, error) {
+	embed, ok := Embedders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown embedder %q", name)
+	}
+	return embed, nil
+}
@@ -0,0 +1,266 @@
+// Package rag finds passages of local documents relevant to a query, so
+// that answers can draw on and cite them. Documents are split into chunks
+// that are embedded once, when ingested, and kept with their vectors.
+package rag
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"server/config"
+	"server/llm"
+	"server/usage"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Chunk is a passage of a document. Its ID, like "guide.md#3", is what
+// prompts and history cite.
+type Chunk struct {
+	ID     string    `json:"id"`
+	Source string    `json:"source"`
+	Text   string    `json:"text"`
+	Vector []float32 `json:"vector"`
+	// Digest is the hash of the whole document, to tell when it changed.
+	Digest string `json:"digest"`
+}
+
+type Result struct {
+	Chunk
+	Score float64
+}
+
+// Extensions are the files Ingest reads.
+var Extensions = []string{".txt", ".md", ".markdown"}
+
+// Embeddings are only sent this many at a time.
+const batchSize = 100
+
+var (
+	chunks   []Chunk
+	ragMutex sync.RWMutex
+)
+
+// stored is the index file's format. Vectors from another embedder mean
+// nothing to this one, so a file made with one is not loaded with another.
+type stored struct {
+	Embedder string  `json:"embedder"`
+	Chunks   []Chunk `json:"chunks"`
+}
+
+// Initialize loads the index from config.RAGIndex, then ingests
+// config.RAGDocs, embedding only documents that changed.
+func Initialize() {
+	if _, err := embedder(config.RAGEmbedder); err != nil {
+		panic(fmt.Sprintf("RAG_EMBEDDER: %v", err))
+	}
+	if config.RAGIndex != "" {
+		if err := load(config.RAGIndex); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Cannot load the document index, starting empty: %v\n", err)
+		}
+	}
+	if config.RAGDocs != "" {
+		n, err := Ingest(config.RAGDocs)
+		if err != nil {
+			fmt.Printf("Cannot ingest %s: %v\n", config.RAGDocs, err)
+		}
+		fmt.Printf("Document index has %d chunks, %d new\n", Size(), n)
+	}
+}
+
+func Size() int {
+	ragMutex.RLock()
+	defer ragMutex.RUnlock()
+	return len(chunks)
+}
+
+// Ingest adds the documents in a file or directory, replacing the chunks
+// of documents ingested before, and returns how many chunks it embedded.
+// Sources are named relative to the directory.
+func Ingest(root string) (int, error) {
+	embed, err := embedder(config.RAGEmbedder)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return 0, err
+	}
+	base := root
+	if !info.IsDir() {
+		base = filepath.Dir(root)
+	}
+
+	added := 0
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !hasExtension(path) {
+			return err
+		}
+		source, _ := filepath.Rel(base, path)
+		n, err := ingestFile(embed, path, filepath.ToSlash(source))
+		added += n
+		return err
+	})
+	if err != nil {
+		return added, err
+	}
+	if config.RAGIndex != "" && added > 0 {
+		if err := save(config.RAGIndex); err != nil {
+			return added, fmt.Errorf("saving the index: %w", err)
+		}
+	}
+	return added, nil
+}
+
+func hasExtension(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func ingestFile(embed Embedder, path string, source string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	ragMutex.RLock()
+	for _, c := range chunks {
+		if c.Source == source && c.Digest == digest {
+			ragMutex.RUnlock()
+			return 0, nil
+		}
+	}
+	ragMutex.RUnlock()
+
+	size := max(config.RAGChunkWords, 1)
+	texts := split(string(data), size, min(config.RAGChunkOverlap, size/2))
+	var fresh []Chunk
+	for start := 0; start < len(texts); start += batchSize {
+		batch := texts[start:min(start+batchSize, len(texts))]
+		vectors, spent, err := embed(batch)
+		usage.Record(config.Port, "ingest", spent)
+		if err != nil {
+			return 0, fmt.Errorf("embedding %s: %w", source, err)
+		}
+		for i, text := range batch {
+			fresh = append(fresh, Chunk{
+				ID:     chunkID(source, start+i+1),
+				Source: source,
+				Text:   text,
+				Vector: vectors[i],
+				Digest: digest,
+			})
+		}
+	}
+
+	ragMutex.Lock()
+	defer ragMutex.Unlock()
+	kept := chunks[:0]
+	for _, c := range chunks {
+		if c.Source != source {
+			kept = append(kept, c)
+		}
+	}
+	chunks = append(kept, fresh...)
+	return len(fresh), nil
+}
+
+// Retrieve returns the k chunks closest to the query, best first, and what
+// embedding the query used.
+func Retrieve(query string, k int) ([]Result, llm.Usage, error) {
+	embed, err := embedder(config.RAGEmbedder)
+	if err != nil {
+		return nil, llm.Usage{}, err
+	}
+	vectors, usage, err := embed([]string{query})
+	if err != nil {
+		return nil, usage, err
+	}
+	ragMutex.RLock()
+	defer ragMutex.RUnlock()
+	results := make([]Result, 0, len(chunks))
+	for _, c := range chunks {
+		if score := llm.Cosine(vectors[0], c.Vector); score > 0 {
+			results = append(results, Result{Chunk: c, Score: score})
+		}
+	}
+	// Ties go by ID so every replica picks the same chunks.
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results[:min(k, len(results))], usage, nil
+}
+
+// Prompt lists the chunks for the model to draw on, by ID.
+func Prompt(results []Result) string {
+	if len(results) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Documents:\n")
+	for _, r := range results {
+		fmt.Fprintf(&b, "[%s] %s\n", r.ID, r.Text)
+	}
+	return b.String()
+}
+
+// Turn records the chunks given with a query as a history turn.
+func Turn(results []Result) string {
+	if len(results) == 0 {
+		return ""
+	}
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return "\nSources: " + strings.Join(ids, ", ")
+}
+
+func load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var s stored
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s.Embedder != config.RAGEmbedder {
+		return fmt.Errorf("it was made with the %s embedder", s.Embedder)
+	}
+	ragMutex.Lock()
+	defer ragMutex.Unlock()
+	chunks = s.Chunks
+	return nil
+}
+
+// save writes the index through a temporary file, so a crash never leaves
+// half of it behind.
+func save(path string) error {
+	ragMutex.RLock()
+	data, err := json.Marshal(stored{Embedder: config.RAGEmbedder, Chunks: chunks})
+	ragMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
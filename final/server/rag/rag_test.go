@@ -0,0 +1,90 @@
+package rag
+
+import (
+	"server/config"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"empty", " \n\n ", 4, 1, nil},
+		{"shorter than a chunk", "a b c", 4, 1, []string{"a b c"}},
+		{"overlapping chunks", "1 2 3 4 5 6 7 8 9 10", 4, 1, []string{"1 2 3 4", "4 5 6 7", "7 8 9 10"}},
+		{"wider overlap", "1 2 3 4 5 6", 4, 2, []string{"1 2 3 4", "3 4 5 6"}},
+		{"no chunk of overlap alone", "1 2 3 4 5 6 7", 4, 1, []string{"1 2 3 4", "4 5 6 7"}},
+		{"no overlap", "1 2 3 4 5", 2, 0, []string{"1 2", "3 4", "5"}},
+		{"ends at a paragraph break", "a b\n\nc d e", 4, 1, []string{"a b", "b c d e"}},
+		{"paragraphs that fit together", "a b\n\nc d", 4, 1, []string{"a b c d"}},
+		{"windows line endings", "a b\r\n\r\nc d e", 4, 1, []string{"a b", "b c d e"}},
+		{"a paragraph longer than a chunk", "a\n\nb c d e f g", 4, 1, []string{"a", "a b c d", "d e f g"}},
+	}
+	for _, test := range tests {
+		got := split(test.text, test.size, test.overlap)
+		if strings.Join(got, "|") != strings.Join(test.want, "|") || len(got) != len(test.want) {
+			t.Errorf("%s: split(%q, %d, %d) = %q, want %q", test.name, test.text, test.size, test.overlap, got, test.want)
+		}
+	}
+}
+
+// index replaces the chunks with texts embedded by HashEmbed, by ID.
+func index(t *testing.T, texts map[string]string) {
+	t.Helper()
+	config.RAGEmbedder = "hash"
+	chunks = nil
+	for id, text := range texts {
+		vectors, _, err := HashEmbed([]string{text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, Chunk{ID: id, Text: text, Vector: vectors[0]})
+	}
+	t.Cleanup(func() { chunks = nil })
+}
+
+func TestRetrieve(t *testing.T) {
+	index(t, map[string]string{
+		"b.md#1":  "the capital of France is Paris",
+		"a.md#2":  "the capital of France is Paris",
+		"a.md#1":  "the capital of France is Paris",
+		"c.md#1":  "Paris is in France",
+		"z.md#1":  "bread and cheese",
+		"zz.md#1": "the capital of France is Paris, on the Seine",
+	})
+	tests := []struct {
+		query string
+		k     int
+		want  []string
+	}{
+		// Equal scores go by ID, whatever the order of the index.
+		{"the capital of France is Paris", 3, []string{"a.md#1", "a.md#2", "b.md#1"}},
+		{"the capital of France is Paris", 5, []string{"a.md#1", "a.md#2", "b.md#1", "zz.md#1", "c.md#1"}},
+		// Chunks sharing no word with the query are never returned.
+		{"cheese", 10, []string{"z.md#1"}},
+		{"nothing alike", 10, nil},
+	}
+	for _, test := range tests {
+		results, _, err := Retrieve(test.query, test.k)
+		if err != nil {
+			t.Fatalf("Retrieve(%q, %d): %v", test.query, test.k, err)
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("Retrieve(%q, %d) = %v, want %v", test.query, test.k, got, test.want)
+		}
+		for i := 1; i < len(results); i++ {
+			if results[i].Score > results[i-1].Score {
+				t.Errorf("Retrieve(%q, %d) is not best first: %v", test.query, test.k, results)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package selection picks the answer to commit from the nodes' candidates
+// without waiting for an operator to type choose.
+package selection
+
+import (
+	"fmt"
+	"server/config"
+	"server/llm"
+	"server/usage"
+	"strings"
+	"unicode"
+)
+
+// Candidate is a usable answer, in the order it arrived at the leader.
+type Candidate struct {
+	ID   string
+	Text string
+}
+
+// Policy returns the ID of the candidate to commit for context id. history
+// is the context's history ending with the query being answered.
+type Policy func(id string, history string, candidates []Candidate) (string, error)
+
+// Manual leaves the choice to the operator and is the default.
+const Manual = "manual"
+
+var Policies = map[string]Policy{
+	"first":      First,
+	"majority":   Majority,
+	"longest":    Longest,
+	"shortest":   Shortest,
+	"similarity": Similarity,
+	"judge":      Judge,
+}
+
+// Valid reports whether name is a policy or manual.
+func Valid(name string) bool {
+	_, ok := Policies[name]
+	return ok || name == Manual
+}
+
+// First picks the candidate that arrived first.
+func First(id string, history string, candidates []Candidate) (string, error) {
+	return candidates[0].ID, nil
+}
+
+// Majority picks the answer most candidates agree on after normalizing
+// case, punctuation and spacing. Ties go to the answer that arrived first.
+func Majority(id string, history string, candidates []Candidate) (string, error) {
+	counts := make(map[string]int)
+	for _, c := range candidates {
+		counts[normalize(c.Text)]++
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if counts[normalize(c.Text)] > counts[normalize(best.Text)] {
+			best = c
+		}
+	}
+	return best.ID, nil
+}
+
+func Longest(id string, history string, candidates []Candidate) (string, error) {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if len(c.Text) > len(best.Text) {
+			best = c
+		}
+	}
+	return best.ID, nil
+}
+
+func Shortest(id string, history string, candidates []Candidate) (string, error) {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if len(c.Text) < len(best.Text) {
+			best = c
+		}
+	}
+	return best.ID, nil
+}
+
+// Similarity embeds every answer and picks the one closest in meaning to
+// all the others, the consensus answer.
+func Similarity(id string, history string, candidates []Candidate) (string, error) {
+	if len(candidates) < 3 {
+		// With two answers neither is closer to the consensus.
+		return candidates[0].ID, nil
+	}
+	texts := make([]string, len(candidates))
+	for i, c := range candidates {
+		texts[i] = c.Text
+	}
+	if err := usage.Check(config.Port, id); err != nil {
+		return "", err
+	}
+	vectors, spent, err := llm.Embed(texts)
+	usage.Record(config.Port, id, spent)
+	if err != nil {
+		return "", err
+	}
+	best, bestScore := 0, -1.0
+	for i := range vectors {
+		score := 0.0
+		for j := range vectors {
+			if i != j {
+				score += llm.Cosine(vectors[i], vectors[j])
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return candidates[best].ID, nil
+}
+
+// Judge asks the model itself to pick the best answer.
+func Judge(id string, history string, candidates []Candidate) (string, error) {
+	texts := make([]string, len(candidates))
+	for i, c := range candidates {
+		texts[i] = c.Text
+	}
+	if err := usage.Check(config.Port, id); err != nil {
+		return "", fmt.Errorf("judge: %w", err)
+	}
+	index, spent, err := llm.Judge(history, texts)
+	usage.Record(config.Port, id, spent)
+	if err != nil {
+		return "", fmt.Errorf("judge: %w", err)
+	}
+	return candidates[index].ID, nil
+}
+
+func normalize(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,28 @@
+package selection
+
+import "testing"
+
+func TestMajority(t *testing.T) {
+	tests := []struct {
+		name  string
+		texts []string
+		want  string
+	}{
+		{"one candidate", []string{"Paris"}, "0"},
+		{"most agree", []string{"Lyon", "Paris", "Paris"}, "1"},
+		{"case, punctuation and spacing are ignored", []string{"Lyon", "Paris.", "  paris ", "PARIS!"}, "1"},
+		{"ties go to the first to arrive", []string{"Lyon", "Paris", "Paris", "Lyon"}, "0"},
+		{"no agreement", []string{"Lyon", "Paris", "Nice"}, "0"},
+		{"the words still count", []string{"New York", "Newyork", "new york"}, "0"},
+	}
+	for _, test := range tests {
+		candidates := make([]Candidate, len(test.texts))
+		for i, text := range test.texts {
+			candidates[i] = Candidate{ID: string(rune('0' + i)), Text: text}
+		}
+		got, err := Majority("ctx", "", candidates)
+		if err != nil || got != test.want {
+			t.Errorf("%s: Majority(%q) = %s, %v, want %s", test.name, test.texts, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package selection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// round collects the candidates for one query on the leader.
+type round struct {
+	// seq numbers the query, so that candidates for an earlier one are
+	// not counted.
+	seq        int
+	policy     string
+	history    string
+	expected   int
+	candidates []Candidate
+	failures   int
+	timer      *time.Timer
+	done       bool
+	choose     func(candidateID string)
+}
+
+var (
+	rounds      = make(map[string]*round)
+	roundsMutex sync.Mutex
+)
+
+// Begin starts collecting candidates for a query on context id. The policy
+// runs once expected candidates have arrived or failed, or when timeout
+// fires with at least one candidate in; "first" runs on the first
+// arrival. choose is called with the selected candidate's ID.
+func Begin(id string, seq int, policy string, history string, expected int, timeout time.Duration, choose func(candidateID string)) {
+	if policy == Manual || Policies[policy] == nil {
+		return
+	}
+	r := &round{seq: seq, policy: policy, history: history, expected: expected, choose: choose}
+	roundsMutex.Lock()
+	defer roundsMutex.Unlock()
+	if old, ok := rounds[id]; ok {
+		old.timer.Stop()
+	}
+	rounds[id] = r
+	r.timer = time.AfterFunc(timeout, func() {
+		roundsMutex.Lock()
+		defer roundsMutex.Unlock()
+		if rounds[id] != r || r.done {
+			return
+		}
+		if len(r.candidates) == 0 {
+			fmt.Printf("(%s) No candidates within %s, leaving the choice to the operator\n", id, timeout)
+			delete(rounds, id)
+			return
+		}
+		fmt.Printf("(%s) Selecting after %s with %d of %d candidates\n", id, timeout, len(r.candidates), r.expected)
+		decideLocked(id, r)
+	})
+}
+
+// Add records a usable candidate for query seq on context id.
+func Add(id string, seq int, candidate Candidate) {
+	roundsMutex.Lock()
+	defer roundsMutex.Unlock()
+	r, ok := rounds[id]
+	if !ok || r.done || r.seq != seq {
+		return
+	}
+	r.candidates = append(r.candidates, candidate)
+	if r.policy == "first" || len(r.candidates)+r.failures >= r.expected {
+		decideLocked(id, r)
+	}
+}
+
+// Fail records count candidates for query seq that will not arrive, one
+// for a failed candidate and all of a node's for a failed node.
+func Fail(id string, seq int, count int) {
+	roundsMutex.Lock()
+	defer roundsMutex.Unlock()
+	r, ok := rounds[id]
+	if !ok || r.done || r.seq != seq {
+		return
+	}
+	r.failures += count
+	if len(r.candidates)+r.failures < r.expected {
+		return
+	}
+	if len(r.candidates) == 0 {
+		fmt.Printf("(%s) Every candidate failed, leaving the choice to the operator\n", id)
+		r.timer.Stop()
+		delete(rounds, id)
+		return
+	}
+	decideLocked(id, r)
+}
+
+// End stops automatic selection for context id, when the operator chose.
+func End(id string) {
+	roundsMutex.Lock()
+	defer roundsMutex.Unlock()
+	if r, ok := rounds[id]; ok {
+		r.timer.Stop()
+		r.done = true
+		delete(rounds, id)
+	}
+}
+
+// decideLocked runs the policy outside the lock, since similarity and
+// judge call the model.
+func decideLocked(id string, r *round) {
+	r.done = true
+	r.timer.Stop()
+	delete(rounds, id)
+	candidates := append([]Candidate(nil), r.candidates...)
+	go func() {
+		selected, err := Policies[r.policy](id, r.history, candidates)
+		if err != nil {
+			// Fall back to the first candidate rather than stall.
+			fmt.Printf("(%s) Policy %s failed, taking the first candidate: %v\n", id, r.policy, err)
+			selected = candidates[0].ID
+		}
+		fmt.Printf("(%s) Policy %s selected %s\n", id, r.policy, selected)
+		r.choose(selected)
+	}()
+}
@@ -0,0 +1,118 @@
+package selection
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// begin starts a round that only a full count can complete and returns the
+// channel the choice arrives on.
+func begin(t *testing.T, id string, seq int, expected int) chan string {
+	t.Helper()
+	chosen := make(chan string, 1)
+	Begin(id, seq, "longest", "Query: q", expected, time.Minute, func(candidateID string) {
+		chosen <- candidateID
+	})
+	t.Cleanup(func() { End(id) })
+	return chosen
+}
+
+func pending(id string) bool {
+	roundsMutex.Lock()
+	defer roundsMutex.Unlock()
+	_, ok := rounds[id]
+	return ok
+}
+
+func waitChoice(t *testing.T, chosen chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-chosen:
+		if got != want {
+			t.Errorf("chose %s, want %s", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no choice made, want %s", want)
+	}
+}
+
+func TestRoundCompletesWithFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+		// Each step fails that many candidates, or adds one when 0.
+		steps []int
+		want  string
+	}{
+		{"one candidate then the rest fail", 3, []int{0, 1, 1}, "7000"},
+		{"a whole node fails at once", 6, []int{1, 0, 3, 0}, "7000.2"},
+		{"failures before any candidate", 4, []int{3, 0}, "7000"},
+	}
+	for _, test := range tests {
+		id := "ctx-" + test.name
+		chosen := begin(t, id, 1, test.expected)
+		added := 0
+		for i, fail := range test.steps {
+			if !pending(id) {
+				t.Fatalf("%s: round ended before step %d", test.name, i)
+			}
+			if fail > 0 {
+				Fail(id, 1, fail)
+				continue
+			}
+			candidateID := "7000"
+			if added > 0 {
+				candidateID = "7000.2"
+			}
+			// Later candidates are longer, so longest picks the last.
+			Add(id, 1, Candidate{ID: candidateID, Text: "answer" + strings.Repeat("!", added)})
+			added++
+		}
+		waitChoice(t, chosen, test.want)
+		if pending(id) {
+			t.Errorf("%s: round still open after it completed", test.name)
+		}
+	}
+}
+
+func TestRoundWaitsForEveryCandidate(t *testing.T) {
+	chosen := begin(t, "ctx", 1, 6)
+	Add("ctx", 1, Candidate{ID: "7000", Text: "a"})
+	Fail("ctx", 1, 3)
+	Fail("ctx", 1, 1)
+	if !pending("ctx") {
+		t.Fatal("round ended with 5 of 6 candidates in")
+	}
+	select {
+	case got := <-chosen:
+		t.Fatalf("chose %s with 5 of 6 candidates in", got)
+	default:
+	}
+}
+
+func TestRoundEveryCandidateFails(t *testing.T) {
+	chosen := begin(t, "ctx", 1, 6)
+	Fail("ctx", 1, 3)
+	Fail("ctx", 1, 3)
+	if pending("ctx") {
+		t.Error("round still open after every candidate failed")
+	}
+	select {
+	case got := <-chosen:
+		t.Errorf("chose %s with no candidates", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRoundIgnoresEarlierQueries(t *testing.T) {
+	chosen := begin(t, "ctx", 2, 2)
+	Fail("ctx", 1, 2)
+	Add("ctx", 1, Candidate{ID: "7001", Text: "stale"})
+	if !pending("ctx") {
+		t.Fatal("reports for query 1 ended the round for query 2")
+	}
+	Add("ctx", 2, Candidate{ID: "7000", Text: "a"})
+	Fail("ctx", 2, 1)
+	waitChoice(t, chosen, "7000")
+}
@@ -0,0 +1,91 @@
+// Package stream publishes candidates to operators over Server-Sent Events
+// while they are being generated.
+package stream
+
+import (
+	"sync"
+)
+
+// Event is something an operator watching a context wants to see as it
+// happens. Partial events carry the text generated since the last one for
+// that candidate.
+type Event struct {
+	Type      string `json:"type"`
+	Context   string `json:"context"`
+	Candidate string `json:"candidate,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+// A subscriber further than this many events behind is disconnected
+// rather than holding up the nodes' messages.
+const subscriberBuffer = 256
+
+type subscriber struct {
+	context string
+	events  chan Event
+}
+
+var (
+	subscribers = make(map[*subscriber]struct{})
+	// generated holds the text streamed so far for the current query, by
+	// context and candidate, so late subscribers can catch up.
+	generated   = make(map[string]map[string]string)
+	streamMutex sync.Mutex
+)
+
+// Subscribe returns the events for a context, or for every context when
+// context is empty, starting with the text generated so far. The channel is
+// closed after cancel is called or if the subscriber falls behind.
+func Subscribe(context string) (<-chan Event, func()) {
+	s := &subscriber{context: context, events: make(chan Event, subscriberBuffer)}
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+	for id, candidates := range generated {
+		if context != "" && id != context {
+			continue
+		}
+		for candidate, text := range candidates {
+			if len(s.events) < subscriberBuffer {
+				s.events <- Event{Type: "partial", Context: id, Candidate: candidate, Text: text}
+			}
+		}
+	}
+	subscribers[s] = struct{}{}
+	cancel := func() {
+		streamMutex.Lock()
+		defer streamMutex.Unlock()
+		if _, ok := subscribers[s]; ok {
+			delete(subscribers, s)
+			close(s.events)
+		}
+	}
+	return s.events, cancel
+}
+
+// Publish sends an event to the context's subscribers. "query" and "chosen"
+// events start and end a query, so the generated text is forgotten.
+func Publish(e Event) {
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+	switch e.Type {
+	case "partial":
+		if generated[e.Context] == nil {
+			generated[e.Context] = make(map[string]string)
+		}
+		generated[e.Context][e.Candidate] += e.Text
+	case "query", "chosen":
+		delete(generated, e.Context)
+	}
+	for s := range subscribers {
+		if s.context != "" && s.context != e.Context {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(subscribers, s)
+			close(s.events)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var Calculator = &Tool{
+	Name:        "calculator",
+	Description: "Evaluates an arithmetic expression with + - * / % ^, parentheses and sqrt, abs, round, floor and ceil, and returns the exact result.",
+	Params: []Param{
+		{Name: "expression", Type: "string", Description: "The expression, like (2 + 3) * sqrt(16)", Required: true},
+	},
+	Run: func(args map[string]any) (string, error) {
+		value, err := Evaluate(stringArg(args, "expression"))
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	},
+}
+
+var functions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"round": math.Round,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+}
+
+// Evaluate computes an arithmetic expression. ^ binds tightest and to the
+// right, then unary minus, then * / %, then + -.
+func Evaluate(expression string) (float64, error) {
+	p := &parser{text: strings.TrimSpace(expression)}
+	if p.text == "" {
+		return 0, errors.New("empty expression")
+	}
+	value, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return 0, fmt.Errorf("unexpected %q at %d", p.text[p.pos:], p.pos)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return value, nil
+}
+
+type parser struct {
+	text  string
+	pos   int
+	depth int
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) sum() (float64, error) {
+	left, err := p.product()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var right float64
+		if right, err = p.product(); err == nil {
+			if op == '+' {
+				left += right
+			} else {
+				left -= right
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) product() (float64, error) {
+	left, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		p.pos++
+		var right float64
+		if right, err = p.unary(); err != nil {
+			break
+		}
+		switch {
+		case op == '*':
+			left *= right
+		case right == 0:
+			err = errors.New("division by zero")
+		case op == '/':
+			left /= right
+		default:
+			left = math.Mod(left, right)
+		}
+	}
+	return left, err
+}
+
+// unary is on every recursive path, through signs, exponents and
+// parentheses alike, so it is where depth is limited.
+func (p *parser) unary() (float64, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > 100 {
+		return 0, errors.New("expression nested too deeply")
+	}
+	if p.peek() == '-' {
+		p.pos++
+		value, err := p.unary()
+		return -value, err
+	}
+	if p.peek() == '+' {
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *parser) power() (float64, error) {
+	base, err := p.operand()
+	if err != nil || p.peek() != '^' {
+		return base, err
+	}
+	p.pos++
+	exponent, err := p.unary()
+	return math.Pow(base, exponent), err
+}
+
+func (p *parser) operand() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		value, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return value, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.text) && strings.IndexByte("0123456789.eE", p.text[p.pos]) >= 0 {
+			if (p.text[p.pos] == 'e' || p.text[p.pos] == 'E') && p.pos+1 < len(p.text) && (p.text[p.pos+1] == '-' || p.text[p.pos+1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %q", p.text[start:p.pos])
+		}
+		return value, nil
+	case c >= 'a' && c <= 'z':
+		start := p.pos
+		for p.pos < len(p.text) && p.text[p.pos] >= 'a' && p.text[p.pos] <= 'z' {
+			p.pos++
+		}
+		name := p.text[start:p.pos]
+		if name == "pi" {
+			return math.Pi, nil
+		}
+		function, ok := functions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown function %q", name)
+		}
+		if p.peek() != '(' {
+			return 0, fmt.Errorf("expected ( after %s", name)
+		}
+		value, err := p.operand()
+		return function(value), err
+	case c == 0:
+		return 0, errors.New("unexpected end of expression")
+	}
+	return 0, fmt.Errorf("unexpected %q at %d", c, p.pos)
+}
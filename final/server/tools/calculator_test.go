@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"--3", 3},
+		{"+-+3", -3},
+		{"7 % 3", 1},
+		{"7 / 2", 3.5},
+		{"1.5e3 + 1e-3", 1500.001},
+		{"sqrt(16) + abs(-2)", 6},
+		{"round(2.5) + floor(2.7) + ceil(2.1)", 8},
+		{"2 * pi", 2 * math.Pi},
+		{"  4  ", 4},
+	}
+	for _, test := range tests {
+		got, err := Evaluate(test.expression)
+		if err != nil || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("Evaluate(%q) = %g, %v, want %g", test.expression, got, err, test.want)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"", "empty expression"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", "missing )"},
+		{"1 / 0", "division by zero"},
+		{"1 % 0", "division by zero"},
+		{"2 3", "unexpected"},
+		{"1..2", "bad number"},
+		{"cos(0)", "unknown function"},
+		{"sqrt 4", "expected ( after sqrt"},
+		{"sqrt(-1)", "not a finite number"},
+		{"10 ^ 400", "not a finite number"},
+		{"$", "unexpected"},
+		{strings.Repeat("-", 1000000) + "1", "nested too deeply"},
+		{strings.Repeat("2^", 100000) + "1", "nested too deeply"},
+		{strings.Repeat("(", 1000) + "1" + strings.Repeat(")", 1000), "nested too deeply"},
+		{strings.Repeat("sqrt(", 1000) + "1" + strings.Repeat(")", 1000), "nested too deeply"},
+	}
+	for _, test := range tests {
+		got, err := Evaluate(test.expression)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			name := test.expression
+			if len(name) > 20 {
+				name = name[:20] + "..."
+			}
+			t.Errorf("Evaluate(%q) = %g, %v, want an error containing %q", name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"server/config"
+	"slices"
+	"time"
+)
+
+const maxFetchBytes = 16 << 10
+
+var fetchClient = &http.Client{
+	Timeout: 5 * time.Second,
+	// Redirects could lead off the allowlist.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var Fetch = &Tool{
+	Name:        "fetch",
+	Description: "Fetches a URL from one of the local services the operator allowed with an HTTP GET and returns the status and body.",
+	Params: []Param{
+		{Name: "url", Type: "string", Description: "The URL, like http://localhost:8080/status", Required: true},
+	},
+	Run: func(args map[string]any) (string, error) {
+		u, err := url.Parse(stringArg(args, "url"))
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return "", errors.New("not an http or https URL")
+		}
+		if !slices.Contains(config.FetchAllow, u.Host) {
+			return "", fmt.Errorf("%s is not an allowed service", u.Host)
+		}
+		resp, err := fetchClient.Get(u.String())
+		if err != nil {
+			return "", errors.Unwrap(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes+1))
+		if err != nil {
+			return "", err
+		}
+		if len(body) > maxFetchBytes {
+			return fmt.Sprintf("%s\n%s\n[truncated]", resp.Status, body[:maxFetchBytes]), nil
+		}
+		return fmt.Sprintf("%s\n%s", resp.Status, body), nil
+	},
+}
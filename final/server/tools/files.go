@@ -0,0 +1,110 @@
+package tools
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"server/config"
+	"strings"
+)
+
+// Files returns at most this much of a file, and at most maxMatches lines
+// when searching.
+const (
+	maxFileBytes = 8 << 10
+	maxMatches   = 50
+)
+
+var Files = &Tool{
+	Name:        "files",
+	Description: "Reads a local text file, or with query, lists its lines containing the query, case insensitively, with their line numbers. Without path, lists the files.",
+	Params: []Param{
+		{Name: "path", Type: "string", Description: "The file's path relative to the document directory"},
+		{Name: "query", Type: "string", Description: "Text to search the file for"},
+	},
+	Run: func(args map[string]any) (string, error) {
+		if config.ToolsDir == "" {
+			return "", errors.New("no document directory is configured")
+		}
+		path := stringArg(args, "path")
+		if path == "" {
+			return listFiles()
+		}
+		resolved, err := resolve(path)
+		if err != nil {
+			return "", err
+		}
+		file, err := os.Open(resolved)
+		if err != nil {
+			return "", fmt.Errorf("cannot open %s", path)
+		}
+		defer file.Close()
+		if query := strings.ToLower(stringArg(args, "query")); query != "" {
+			return search(file, query)
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxFileBytes+1))
+		if err != nil {
+			return "", err
+		}
+		if len(data) > maxFileBytes {
+			return string(data[:maxFileBytes]) + "\n[truncated]", nil
+		}
+		return string(data), nil
+	},
+}
+
+// resolve finds path in the document directory, following symlinks so that
+// one pointing outside it is refused like a path with "..".
+func resolve(path string) (string, error) {
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("%s is outside the document directory", path)
+	}
+	root, err := filepath.EvalSymlinks(config.ToolsDir)
+	if err != nil {
+		return "", errors.New("cannot open the document directory")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", fmt.Errorf("cannot open %s", path)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the document directory", path)
+	}
+	return resolved, nil
+}
+
+func listFiles() (string, error) {
+	var names []string
+	err := filepath.WalkDir(config.ToolsDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || len(names) >= maxMatches {
+			return err
+		}
+		rel, _ := filepath.Rel(config.ToolsDir, path)
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+func search(file io.Reader, query string) (string, error) {
+	var matches []string
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan() && len(matches) < maxMatches; n++ {
+		if strings.Contains(strings.ToLower(scanner.Text()), query) {
+			matches = append(matches, fmt.Sprintf("%d: %s", n, scanner.Text()))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "no matches", nil
+	}
+	return strings.Join(matches, "\n"), nil
+}
@@ -0,0 +1,176 @@
+// Package tools holds the tools the model may call while answering, and
+// records their calls so they can be committed with the answer.
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Param describes an argument of a tool for the model. Type is "string" or
+// "number".
+type Param struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+type Tool struct {
+	Name        string
+	Description string
+	Params      []Param
+	Run         func(args map[string]any) (string, error)
+}
+
+var Registry = map[string]*Tool{
+	"calculator": Calculator,
+	"files":      Files,
+	"fetch":      Fetch,
+}
+
+// Parse checks a context's tools setting, a comma separated list of tool
+// names or "all", and returns the names sorted.
+func Parse(value string) ([]string, error) {
+	if value == "all" {
+		names := make([]string, 0, len(Registry))
+		for name := range Registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if _, ok := Registry[name]; !ok {
+			return nil, fmt.Errorf("unknown tool %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Call is a tool the model called, with its arguments as JSON, and the
+// result it was given.
+type Call struct {
+	Name   string
+	Args   string
+	Result string
+}
+
+const label = "Tool: "
+
+// String formats the call as a turn in a context's history, on one line:
+// Tool: calculator {"expression":"2+2"} -> "4"
+func (c Call) String() string {
+	return fmt.Sprintf("%s%s %s -> %s", label, c.Name, c.Args, strconv.Quote(c.Result))
+}
+
+// ParseCall reads a turn formatted by Call.String.
+func ParseCall(line string) (Call, bool) {
+	rest, ok := strings.CutPrefix(line, label)
+	if !ok {
+		return Call{}, false
+	}
+	name, rest, ok := strings.Cut(rest, " ")
+	if !ok {
+		return Call{}, false
+	}
+	// The arguments may contain " -> " themselves, so they are read as
+	// JSON to find where they end.
+	decoder := json.NewDecoder(strings.NewReader(rest))
+	var args json.RawMessage
+	if err := decoder.Decode(&args); err != nil {
+		return Call{}, false
+	}
+	result, ok := strings.CutPrefix(rest[decoder.InputOffset():], " -> ")
+	if !ok {
+		return Call{}, false
+	}
+	unquoted, err := strconv.Unquote(result)
+	if err != nil {
+		return Call{}, false
+	}
+	return Call{Name: name, Args: string(args), Result: unquoted}, true
+}
+
+// Turns formats calls as history turns, each starting with a newline.
+func Turns(calls []Call) string {
+	var b strings.Builder
+	for _, c := range calls {
+		b.WriteString("\n")
+		b.WriteString(c.String())
+	}
+	return b.String()
+}
+
+// Session runs the tools for one query and records every call. Tools run
+// live each time; replicas agree because the calls of the chosen answer are
+// committed to the history with it, not because they are run again.
+type Session struct {
+	tools []*Tool
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewSession enables the named tools.
+func NewSession(names []string) *Session {
+	s := &Session{}
+	for _, name := range names {
+		if tool, ok := Registry[name]; ok {
+			s.tools = append(s.tools, tool)
+		}
+	}
+	return s
+}
+
+func (s *Session) Tools() []*Tool {
+	return s.tools
+}
+
+// Calls returns the calls made so far, in order.
+func (s *Session) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Run calls a tool and records the call. Failures are results too, so the
+// model can see what went wrong.
+func (s *Session) Run(name string, args map[string]any) Call {
+	encoded, _ := json.Marshal(args)
+	call := Call{Name: name, Args: string(encoded), Result: s.run(name, args)}
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+	return call
+}
+
+func (s *Session) run(name string, args map[string]any) string {
+	for _, tool := range s.tools {
+		if tool.Name != name {
+			continue
+		}
+		for _, p := range tool.Params {
+			if _, ok := args[p.Name]; p.Required && !ok {
+				return fmt.Sprintf("error: missing argument %s", p.Name)
+			}
+		}
+		result, err := tool.Run(args)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return result
+	}
+	return fmt.Sprintf("error: no tool %s", name)
+}
+
+func stringArg(args map[string]any, name string) string {
+	value, _ := args[name].(string)
+	return value
+}
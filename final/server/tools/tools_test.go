@@ -0,0 +1,68 @@
+package tools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCallRoundTrip(t *testing.T) {
+	tests := []Call{
+		{Name: "calculator", Args: `{"expression":"2+2"}`, Result: "4"},
+		{Name: "files", Args: `{"path":"a -> b.txt","query":"x"}`, Result: "1: a -> b\n2: \"quoted\""},
+		{Name: "fetch", Args: `{}`, Result: ""},
+	}
+	for _, call := range tests {
+		line := call.String()
+		got, ok := ParseCall(line)
+		if !ok || got != call {
+			t.Errorf("ParseCall(%q) = %+v, %t, want %+v", line, got, ok, call)
+		}
+	}
+	for i, call := range tests {
+		turns := Turns(tests[:i+1])
+		if want := "\n" + call.String(); turns[len(turns)-len(want):] != want {
+			t.Errorf("Turns does not end with %q: %q", want, turns)
+		}
+	}
+}
+
+func TestParseCallRejects(t *testing.T) {
+	for _, line := range []string{
+		"Query: 2+2",
+		"Tool: calculator",
+		`Tool: calculator {"expression": -> "4"`,
+		`Tool: calculator {"expression":"2+2"} "4"`,
+		`Tool: calculator {"expression":"2+2"} -> 4`,
+	} {
+		if call, ok := ParseCall(line); ok {
+			t.Errorf("ParseCall(%q) = %+v, want no call", line, call)
+		}
+	}
+}
+
+func TestSessionRunsLiveAndRecordsInOrder(t *testing.T) {
+	s := NewSession([]string{"calculator", "nonexistent"})
+	if len(s.Tools()) != 1 {
+		t.Fatalf("Tools() = %d tools, want only the calculator", len(s.Tools()))
+	}
+	made := []Call{
+		s.Run("calculator", map[string]any{"expression": "1+1"}),
+		s.Run("calculator", map[string]any{"expression": "1+1"}),
+		s.Run("calculator", map[string]any{}),
+		s.Run("calculator", map[string]any{"expression": "1/0"}),
+		s.Run("files", map[string]any{"path": "a.txt"}),
+	}
+	want := []Call{
+		{Name: "calculator", Args: `{"expression":"1+1"}`, Result: "2"},
+		{Name: "calculator", Args: `{"expression":"1+1"}`, Result: "2"},
+		{Name: "calculator", Args: `{}`, Result: "error: missing argument expression"},
+		{Name: "calculator", Args: `{"expression":"1/0"}`, Result: "error: division by zero"},
+		{Name: "files", Args: `{"path":"a.txt"}`, Result: "error: no tool files"},
+	}
+	if !reflect.DeepEqual(made, want) {
+		t.Errorf("Run returned\n%+v\nwant\n%+v", made, want)
+	}
+	if calls := s.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("Calls() = %+v, want %+v", calls, want)
+	}
+}
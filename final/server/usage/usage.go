@@ -0,0 +1,153 @@
+// Package usage accounts for the tokens and estimated cost of calls to the
+// model, by node, context and day, and enforces the budgets on them.
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"server/config"
+	"server/llm"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBudget = errors.New("over budget")
+
+// Prices are in US dollars per million prompt and completion tokens.
+// Models not listed are counted at no cost.
+var Prices = map[string][2]float64{
+	"gemini-1.5-flash":    {0.075, 0.30},
+	"gemini-1.5-flash-8b": {0.0375, 0.15},
+	"gemini-1.5-pro":      {1.25, 5.00},
+	"gemini-1.0-pro":      {0.50, 1.50},
+}
+
+type Totals struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+}
+
+func (t *Totals) add(u llm.Usage) {
+	t.Requests += u.Requests
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.Cost += Cost(u)
+}
+
+func (t Totals) Tokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+func (t Totals) String() string {
+	return fmt.Sprintf("%d requests, %d prompt + %d completion tokens, $%.4f", t.Requests, t.PromptTokens, t.CompletionTokens, t.Cost)
+}
+
+type key struct {
+	node    string
+	context string
+	day     string
+}
+
+var (
+	totals     = make(map[key]*Totals)
+	usageMutex sync.Mutex
+)
+
+func Cost(u llm.Usage) float64 {
+	price := Prices[strings.TrimPrefix(u.Model, "models/")]
+	return (float64(u.PromptTokens)*price[0] + float64(u.CompletionTokens)*price[1]) / 1e6
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// Record adds what a node used for a context today.
+func Record(node string, context string, u llm.Usage) {
+	if u.Requests == 0 {
+		return
+	}
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	k := key{node, context, today()}
+	if totals[k] == nil {
+		totals[k] = &Totals{}
+	}
+	totals[k].add(u)
+}
+
+// sumLocked totals the records that match.
+func sumLocked(match func(k key) bool) Totals {
+	var sum Totals
+	for k, t := range totals {
+		if match(k) {
+			sum.Requests += t.Requests
+			sum.PromptTokens += t.PromptTokens
+			sum.CompletionTokens += t.CompletionTokens
+			sum.Cost += t.Cost
+		}
+	}
+	return sum
+}
+
+// Check fails with ErrBudget when the node has used up a budget it may
+// spend on the context.
+func Check(node string, context string) error {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	day := today()
+	daily := sumLocked(func(k key) bool { return k.node == node && k.day == day })
+	if config.DailyTokenBudget > 0 && daily.Tokens() >= config.DailyTokenBudget {
+		return fmt.Errorf("%w: node %s used %d of its %d tokens for %s", ErrBudget, node, daily.Tokens(), config.DailyTokenBudget, day)
+	}
+	if config.DailyCostBudget > 0 && daily.Cost >= config.DailyCostBudget {
+		return fmt.Errorf("%w: node %s spent $%.4f of its $%g for %s", ErrBudget, node, daily.Cost, config.DailyCostBudget, day)
+	}
+	if config.ContextTokenBudget > 0 {
+		spent := sumLocked(func(k key) bool { return k.node == node && k.context == context })
+		if spent.Tokens() >= config.ContextTokenBudget {
+			return fmt.Errorf("%w: node %s used %d of its %d tokens for context %s", ErrBudget, node, spent.Tokens(), config.ContextTokenBudget, context)
+		}
+	}
+	return nil
+}
+
+// Report lists the totals by node, context and day, for one context or
+// for all of them when context is "".
+func Report(context string) string {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	var b strings.Builder
+	section := func(title string, field func(k key) string) {
+		groups := make(map[string]bool)
+		for k := range totals {
+			if context == "" || k.context == context {
+				groups[field(k)] = true
+			}
+		}
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "%s:\n", title)
+		for _, name := range names {
+			sum := sumLocked(func(k key) bool {
+				return field(k) == name && (context == "" || k.context == context)
+			})
+			fmt.Fprintf(&b, "  %s: %s\n", name, sum)
+		}
+	}
+	section("By node", func(k key) string { return k.node })
+	if context == "" {
+		section("By context", func(k key) string { return k.context })
+	}
+	section("By day", func(k key) string { return k.day })
+	total := sumLocked(func(k key) bool { return context == "" || k.context == context })
+	fmt.Fprintf(&b, "Total: %s", total)
+	return b.String()
+}
@@ -0,0 +1,192 @@
+// Package window keeps the history sent to the model within its context
+// window, so long conversations keep working once they outgrow it.
+package window
+
+import (
+	"server/llm"
+	"strings"
+)
+
+const (
+	// Window keeps as many of the latest tokens as fit, cutting the oldest
+	// turn kept mid-way if need be.
+	Window = "window"
+	// Drop removes the oldest whole exchanges of a query and its answer.
+	Drop = "drop"
+	// Summarize drops like Drop until the leader has committed a summary
+	// of the older turns, which then replaces them on every replica.
+	Summarize = "summarize"
+)
+
+// Valid reports whether name is a policy.
+func Valid(name string) bool {
+	return name == Window || name == Drop || name == Summarize
+}
+
+var labels = []string{"Query: ", "Answer: ", "Summary: ", "Tool: ", "Sources: "}
+
+// Turns splits history into its turns, each starting with the newline
+// before its label, so that joining them gives back the history. Lines
+// without a label belong to the turn before.
+func Turns(history string) []string {
+	var turns []string
+	start := 0
+	for i := 0; i < len(history); i++ {
+		if history[i] != '\n' || i == start {
+			continue
+		}
+		for _, label := range labels {
+			if strings.HasPrefix(history[i+1:], label) {
+				turns = append(turns, history[start:i])
+				start = i
+				break
+			}
+		}
+	}
+	if start < len(history) {
+		turns = append(turns, history[start:])
+	}
+	return turns
+}
+
+func isSummary(turn string) bool {
+	return strings.HasPrefix(turn, "\nSummary: ")
+}
+
+// exchanges groups turns into a query and what follows it up to the next
+// query. A summary is an exchange on its own.
+func exchanges(turns []string) [][]string {
+	var groups [][]string
+	for _, turn := range turns {
+		if len(groups) == 0 || strings.HasPrefix(turn, "\nQuery: ") || isSummary(turn) || isSummary(groups[len(groups)-1][0]) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], turn)
+	}
+	return groups
+}
+
+// Fit returns what of history to send the model so that it is at most
+// budget tokens. The latest exchange, which holds the query being
+// answered, is always kept whole.
+func Fit(history string, policy string, budget int) string {
+	if llm.CountTokens(history) <= budget {
+		return history
+	}
+	if policy == Window {
+		return slide(history, budget)
+	}
+	return drop(history, budget)
+}
+
+// drop keeps the summary, if any, and the most recent exchanges that fit
+// alongside it.
+func drop(history string, budget int) string {
+	groups := exchanges(Turns(history))
+	if len(groups) == 0 {
+		return history
+	}
+	summary := ""
+	if len(groups) > 1 && isSummary(groups[0][0]) {
+		summary = groups[0][0]
+		groups = groups[1:]
+	}
+	kept := strings.Join(groups[len(groups)-1], "")
+	used := llm.CountTokens(kept)
+	if summary != "" && used+llm.CountTokens(summary) > budget {
+		summary = ""
+	} else {
+		used += llm.CountTokens(summary)
+	}
+	for i := len(groups) - 2; i >= 0; i-- {
+		exchange := strings.Join(groups[i], "")
+		tokens := llm.CountTokens(exchange)
+		if used+tokens > budget {
+			break
+		}
+		kept = exchange + kept
+		used += tokens
+	}
+	return summary + kept
+}
+
+// slide keeps the latest turns that fit, and as many of the last words of
+// the turn before as fit too.
+func slide(history string, budget int) string {
+	turns := Turns(history)
+	groups := exchanges(turns)
+	if len(groups) == 0 {
+		return history
+	}
+	latest := len(turns) - len(groups[len(groups)-1])
+	kept := strings.Join(turns[latest:], "")
+	used := llm.CountTokens(kept)
+	for i := latest - 1; i >= 0; i-- {
+		tokens := llm.CountTokens(turns[i])
+		if used+tokens <= budget {
+			kept = turns[i] + kept
+			used += tokens
+			continue
+		}
+		words := strings.Fields(turns[i])
+		tail := ""
+		for j := len(words) - 1; j >= 0; j-- {
+			next := words[j] + " " + tail
+			if used+llm.CountTokens("\n... "+next) > budget {
+				break
+			}
+			tail = next
+		}
+		if tail != "" {
+			kept = "\n... " + strings.TrimSuffix(tail, " ") + kept
+		}
+		break
+	}
+	return kept
+}
+
+// Plan picks the older turns to summarize once history is over budget:
+// all but the latest exchanges that fit in half of it, so that the summary
+// is not needed again straight away. It returns the number of turns to
+// replace, and zero when nothing needs summarizing.
+func Plan(history string, budget int) (int, string) {
+	if llm.CountTokens(history) <= budget {
+		return 0, ""
+	}
+	groups := exchanges(Turns(history))
+	if len(groups) < 2 {
+		return 0, ""
+	}
+	keep := 1
+	used := llm.CountTokens(strings.Join(groups[len(groups)-1], ""))
+	for i := len(groups) - 2; i > 0; i-- {
+		tokens := llm.CountTokens(strings.Join(groups[i], ""))
+		if used+tokens > budget/2 {
+			break
+		}
+		used += tokens
+		keep++
+	}
+	count := 0
+	var older strings.Builder
+	for _, group := range groups[:len(groups)-keep] {
+		count += len(group)
+		older.WriteString(strings.Join(group, ""))
+	}
+	if count == 0 || count == 1 && isSummary(groups[0][0]) {
+		return 0, ""
+	}
+	return count, strings.TrimPrefix(older.String(), "\n")
+}
+
+// Replace swaps the first count turns of history for a summary. Every
+// replica applies the committed summary this way, so all of them end up
+// with the same history whatever was added since it was planned.
+func Replace(history string, count int, summary string) string {
+	turns := Turns(history)
+	if count > len(turns) {
+		count = len(turns)
+	}
+	summary = strings.ReplaceAll(summary, "\n", " ")
+	return "\nSummary: " + summary + strings.Join(turns[count:], "")
+}
@@ -0,0 +1,102 @@
+package window
+
+import (
+	"server/llm"
+	"strings"
+	"testing"
+)
+
+// tokens is what drop and Plan count for parts kept whole.
+func tokens(parts ...string) int {
+	total := 0
+	for _, part := range parts {
+		total += llm.CountTokens(part)
+	}
+	return total
+}
+
+const (
+	q1 = "\nQuery: what is the capital of France"
+	a1 = "\nAnswer: Paris is the capital of France, and has been for most of the last thousand years"
+	q2 = "\nQuery: and of Germany"
+	a2 = "\nAnswer: Berlin is the capital of Germany"
+	q3 = "\nQuery: and of Italy"
+	s  = "\nSummary: capitals of France and Germany"
+)
+
+func TestTurns(t *testing.T) {
+	history := q1 + "\nsecond line" + a1 + q3
+	want := []string{q1 + "\nsecond line", a1, q3}
+	got := Turns(history)
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Turns(%q) = %q, want %q", history, got, want)
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name    string
+		history string
+		policy  string
+		budget  int
+		want    string
+	}{
+		{"under budget", q1 + a1 + q3, Drop, 1000, q1 + a1 + q3},
+		{"drop the oldest exchange", q1 + a1 + q2 + a2 + q3, Drop, tokens(q2+a2, q3), q2 + a2 + q3},
+		{"drop keeps whole exchanges", q1 + a1 + q2 + a2 + q3, Drop, tokens(q2+a2, q3) - 1, q3},
+		{"the latest exchange is always kept", q1 + a1 + q3, Drop, 1, q3},
+		{"drop keeps the summary", s + q1 + a1 + q2 + a2 + q3, Drop, tokens(s, q2+a2, q3), s + q2 + a2 + q3},
+		{"drop gives up the summary for the latest exchange", s + q1 + a1 + q3, Drop, tokens(q3), q3},
+		{"summarize drops until summarized", q1 + a1 + q2 + a2 + q3, Summarize, tokens(q2+a2, q3), q2 + a2 + q3},
+		{"window keeps whole turns", q1 + a1 + q2 + a2 + q3, Window, tokens(q2, a2, q3), q2 + a2 + q3},
+		{"window cuts the oldest turn kept", q1 + a1 + q2 + a2 + q3, Window, tokens(a2, q3, "\n... Germany"), "\n... Germany" + a2 + q3},
+	}
+	for _, test := range tests {
+		if got := Fit(test.history, test.policy, test.budget); got != test.want {
+			t.Errorf("%s: Fit(%q, %s, %d) = %q, want %q", test.name, test.history, test.policy, test.budget, got, test.want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name      string
+		history   string
+		budget    int
+		wantCount int
+		wantOlder string
+	}{
+		{"under budget", q1 + a1 + q3, 1000, 0, ""},
+		{"a single exchange", q1 + a1, 1, 0, ""},
+		{"only a summary is older", s + q3, 1, 0, ""},
+		{"keep the latest exchange", q1 + a1 + q2 + a2 + q3, 1, 4, "Query: what is the capital of France" + a1 + q2 + a2},
+		{"keep what fits in half the budget", q1 + a1 + q2 + a2 + q3, 2 * tokens(q2+a2, q3), 2, "Query: what is the capital of France" + a1},
+		{"a summary is summarized again", s + q1 + a1 + q3, 1, 3, "Summary: capitals of France and Germany" + q1 + a1},
+	}
+	for _, test := range tests {
+		count, older := Plan(test.history, test.budget)
+		if count != test.wantCount || older != test.wantOlder {
+			t.Errorf("%s: Plan(%q, %d) = %d, %q, want %d, %q", test.name, test.history, test.budget, count, older, test.wantCount, test.wantOlder)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		name    string
+		history string
+		count   int
+		summary string
+		want    string
+	}{
+		{"the planned turns", q1 + a1 + q3, 2, "France", "\nSummary: France" + q3},
+		{"turns added since are kept", q1 + a1 + q2 + a2 + q3, 2, "France", "\nSummary: France" + q2 + a2 + q3},
+		{"a summary stays one turn", q1 + a1 + q3, 2, "France\nParis", "\nSummary: France Paris" + q3},
+		{"more turns than there are", q1 + a1, 5, "France", "\nSummary: France"},
+	}
+	for _, test := range tests {
+		if got := Replace(test.history, test.count, test.summary); got != test.want {
+			t.Errorf("%s: Replace(%q, %d, %q) = %q, want %q", test.name, test.history, test.count, test.summary, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package auth authenticates connections with a shared-secret HMAC
+// challenge and checks each request against the client's role.
+//
+// When a server has auth enabled it opens every connection with a
+// "challenge <nonce>" message. The client answers with an auth request whose
+// text is "<name> <mac>", where mac is the hex HMAC-SHA256 of
+// "<nonce> <name> <client id>" under the client's secret. Servers
+// authenticate to each other the same way with the cluster secret.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"pa1/wire"
+	"strings"
+	"time"
+)
+
+var ErrAuthFailed = errors.New("authentication failed")
+var ErrNotAuthenticated = errors.New("not authenticated")
+var ErrForged = errors.New("client id does not belong to this connection")
+var ErrPermission = errors.New("permission denied")
+
+// HandshakeTimeout bounds how long either side waits during the handshake.
+const HandshakeTimeout = 5 * time.Second
+
+type Role int
+
+const (
+	// Read may look up and watch keys.
+	Read Role = iota
+	// Write may also insert.
+	Write
+	// Admin may also dump the dictionary. Exit is only ever available on
+	// the server console.
+	Admin
+	// Server is another server in the cluster, which may also act for
+	// the clients whose requests it forwards.
+	Server
+)
+
+var roleNames = []string{"read", "write", "admin", "server"}
+
+type Identity struct {
+	Name string
+	Role Role
+}
+
+type clientEntry struct {
+	Secret string `json:"secret"`
+	Role   string `json:"role"`
+}
+
+// fileFormat is the JSON accepted by Load:
+//
+//	{
+//	  "cluster_secret": "...",
+//	  "clients": {"alice": {"secret": "...", "role": "write"}}
+//	}
+type fileFormat struct {
+	ClusterSecret string                 `json:"cluster_secret"`
+	Clients       map[string]clientEntry `json:"clients"`
+}
+
+type client struct {
+	secret []byte
+	role   Role
+}
+
+type Authenticator struct {
+	clusterSecret []byte
+	clients       map[string]client
+}
+
+func (r Role) String() string {
+	if r < Read || r > Server {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames[:Server] {
+		if strings.EqualFold(name, n) {
+			return Role(i), nil
+		}
+	}
+	return Read, fmt.Errorf("unknown role %q, expected read, write or admin", name)
+}
+
+// Allows reports whether the role may send a request with op.
+func (r Role) Allows(op wire.Op) bool {
+	switch op {
+	case wire.OpInsert:
+		return r >= Write
+	case wire.OpDictionary:
+		return r >= Admin
+	}
+	return true
+}
+
+func Load(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.ClusterSecret == "" {
+		return nil, fmt.Errorf("%s: cluster_secret is required", path)
+	}
+	a := &Authenticator{clusterSecret: []byte(file.ClusterSecret), clients: make(map[string]client)}
+	for name, entry := range file.Clients {
+		if name == "" || strings.ContainsAny(name, "- ") {
+			return nil, fmt.Errorf("%s: client name %q may not be empty or contain '-' or spaces", path, name)
+		}
+		if entry.Secret == "" {
+			return nil, fmt.Errorf("%s: client %s has no secret", path, name)
+		}
+		role, err := ParseRole(entry.Role)
+		if err != nil {
+			return nil, fmt.Errorf("%s: client %s: %w", path, name, err)
+		}
+		a.clients[name] = client{secret: []byte(entry.Secret), role: role}
+	}
+	return a, nil
+}
+
+func (a *Authenticator) ClusterSecret() string {
+	return string(a.clusterSecret)
+}
+
+func NewChallenge() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+func Sign(secret string, nonce string, name string, clientID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce + " " + name + " " + clientID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks an auth request against the nonce the server sent. Names
+// not in the client list are taken to be servers and checked against the
+// cluster secret.
+func (a *Authenticator) Verify(nonce string, request wire.Message) (Identity, error) {
+	name, signature, ok := strings.Cut(request.Text, " ")
+	if !ok {
+		return Identity{}, ErrAuthFailed
+	}
+	secret, role := a.clusterSecret, Server
+	if c, ok := a.clients[name]; ok {
+		secret, role = c.secret, c.role
+	}
+	expected := Sign(string(secret), nonce, name, request.ClientID)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return Identity{}, ErrAuthFailed
+	}
+	return Identity{Name: name, Role: role}, nil
+}
+
+// Authorize checks that a request on a connection authenticated as id uses
+// a client ID it may speak for, and that the owner of that client ID may
+// perform the request. Clients own their name and any "<name>-<suffix>";
+// servers may also speak for any known client.
+func (a *Authenticator) Authorize(id Identity, request wire.Message) error {
+	role := id.Role
+	if !owns(id.Name, request.ClientID) {
+		if id.Role != Server {
+			return ErrForged
+		}
+		owner, ok := a.owner(request.ClientID)
+		if !ok {
+			return ErrForged
+		}
+		role = owner.Role
+	}
+	if !role.Allows(request.Op) {
+		return ErrPermission
+	}
+	return nil
+}
+
+func (a *Authenticator) owner(clientID string) (Identity, bool) {
+	name, _, _ := strings.Cut(clientID, "-")
+	c, ok := a.clients[name]
+	if !ok {
+		return Identity{}, false
+	}
+	return Identity{Name: name, Role: c.role}, true
+}
+
+func owns(name string, clientID string) bool {
+	return clientID == name || strings.HasPrefix(clientID, name+"-")
+}
+
+// ClientHandshake answers the server's challenge on a freshly dialed
+// connection, before anything else is sent on it.
+func ClientHandshake(conn *wire.Conn, name string, secret string, clientID string) error {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	nonce, ok := strings.CutPrefix(challenge.Text, "challenge ")
+	if !ok {
+		return fmt.Errorf("expected an auth challenge, got %q", challenge.Text)
+	}
+	request := wire.Message{
+		Kind:     wire.KindRequest,
+		Op:       wire.OpAuth,
+		ClientID: clientID,
+		Text:     name + " " + Sign(secret, nonce, name, clientID),
+	}
+	if err := conn.Write(request); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Text == ErrAuthFailed.Error() {
+		return ErrAuthFailed
+	}
+	if reply.Status != wire.StatusOK || reply.Text != "Authenticated" {
+		return fmt.Errorf("%w: %s", ErrAuthFailed, reply.Text)
+	}
+	return nil
+}
+
+// readReply reads a server message. Text lines from the server are replies,
+// not requests, so they are not parsed.
+func readReply(conn *wire.Conn) (wire.Message, error) {
+	if conn.Protocol == wire.Binary {
+		return conn.Read()
+	}
+	line, err := conn.ReadLine()
+	if err != nil {
+		return wire.Message{}, err
+	}
+	status := wire.StatusOK
+	if line != "Authenticated" && !strings.HasPrefix(line, "challenge ") {
+		status = wire.StatusError
+	}
+	return wire.Message{Kind: wire.KindResponse, Status: status, Text: line}, nil
+}
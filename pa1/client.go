@@ -1,117 +1,683 @@
+//go:build ignore
+
+// Run with: go run client.go
+
 package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
-	"net"
 	"os"
+	"pa1/auth"
+	"pa1/kvclient"
+	"pa1/latency"
+	"pa1/shell"
+	"pa1/tlsutil"
+	"pa1/wire"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var serverMap = make(map[string]net.Conn)
+var serverMap = make(map[string]*wire.Conn)
 var ClientID = ""
 var PortsList []string
-var NetworkDelay = 3
+var Protocol = wire.Binary
+var User, Secret string
+
+// TLSConfig is nil when servers are dialed over plain TCP.
+var TLSConfig *tls.Config
+
+// Client is used for the binary protocol; the text protocol keeps the raw
+// connections in serverMap.
+var Client *kvclient.Client
+
+// Open watches by pattern, for the binary protocol.
+var watches = make(map[string]*kvclient.Watch)
+var watchMutex sync.Mutex
+
+// Output is where replies and notifications are printed. While lines are
+// edited on a terminal it is the shell, which keeps them above the prompt.
+var Output io.Writer = os.Stdout
+var outputMutex sync.Mutex
+var JSONOutput bool
+
+// Shell is nil in -exec mode.
+var Shell *shell.Shell
+
+// inflight counts commands still waiting for replies, so the client can
+// finish them before exiting at the end of its input.
+var inflight sync.WaitGroup
+
+// pending holds the text protocol commands sent to each port that have not
+// been answered yet. Servers answer in request order. Ports whose
+// connection was lost are in lost and fail new commands straight away.
+var pending = make(map[string][]*pendingCommand)
+var lost = make(map[string]bool)
+var pendingMutex sync.Mutex
+
+type pendingCommand struct {
+	command string
+	start   time.Time
+	done    chan bool
+}
+
+// result is one command's outcome. In -json mode it is printed as is.
+type result struct {
+	Command   string  `json:"command"`
+	Port      string  `json:"port,omitempty"`
+	Output    string  `json:"output"`
+	Error     bool    `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+type notificationOutput struct {
+	Watch   string `json:"watch,omitempty"`
+	Key     int    `json:"key"`
+	Value   int    `json:"value"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type commandInfo struct {
+	name  string
+	usage string
+	help  string
+}
+
+var commands = []commandInfo{
+	{"insert", "insert <key> <value> [ttl=<duration>]", "Insert a value, optionally expiring after the ttl"},
+	{"lookup", "lookup <key> [@<version>]", "Look up a key, optionally as of a version"},
+	{"dictionary", "dictionary [@<version>]", "Dump every key, optionally as of a version"},
+	{"watch", "watch <key>|prefix <digits> [@<version>]", "Print changes to a key or prefix, replaying those after the version"},
+	{"unwatch", "unwatch <key>|prefix <digits>", "Stop a watch"},
+	{"batch", "batch <file>", "Run the commands in a file in order, one per line"},
+	{"setdelay", "setdelay [model]", "Show or change the simulated network delay"},
+	{"history", "history", "List earlier commands"},
+	{"help", "help", "List commands"},
+	{"exit", "exit", "Quit without waiting for replies"},
+}
 
 func main() {
 	ports := flag.String("ports", "", "Comma-separated list of ports")
+	protocol := flag.String("protocol", "binary", "Wire protocol: binary or text")
+	delay := flag.String("delay", "constant:3s", "Simulated network delay model, see latency.Parse")
+	delayLog := flag.String("delay-log", "", "File to log injected delays to as CSV, - for stderr")
+	user := flag.String("user", "", "Name to authenticate as, for servers started with -auth")
+	secret := flag.String("secret", os.Getenv("PA1_SECRET"), "Secret for -user, defaults to $PA1_SECRET")
+	tlsCA := flag.String("tls-ca", "", "PEM CA to verify servers with; connects over TLS when set")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate, for servers that require one")
+	tlsKey := flag.String("tls-key", "", "PEM key for -tls-cert")
+	tlsServerName := flag.String("tls-server-name", "localhost", "Name the servers' certificates must be valid for")
+	jsonOutput := flag.Bool("json", false, "Print replies and notifications as JSON, one object per line")
+	execCommands := flag.String("exec", "", "Run these ;-separated commands one after another and exit, with status 1 if any failed")
+	historyFile := flag.String("history", defaultHistoryFile(), "File to keep command history in, empty to keep none")
 	flag.Parse()
 
 	if *ports == "" {
 		log.Fatal("Please provide ports using the -ports flag")
 	}
+	if *tlsCA != "" || *tlsCert != "" {
+		reloader, err := tlsutil.NewReloader(tlsutil.Config{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA, ServerName: *tlsServerName})
+		if err != nil {
+			log.Fatal(err)
+		}
+		TLSConfig = reloader.ClientConfig()
+	}
+	selected, err := wire.ParseProtocol(*protocol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Protocol = selected
+	model, err := latency.Parse(*delay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	latency.Set(model)
+	if err := latency.LogTo(*delayLog); err != nil {
+		log.Fatal(err)
+	}
 
 	Initialize(*ports)
+	User, Secret = *user, *secret
+	if User != "" {
+		// Servers only accept client IDs that start with the
+		// authenticated name.
+		ClientID = User
+	}
 	// println("Client ID: ", ClientID)
-	initalizeConnections()
+	if Protocol == wire.Text {
+		initalizeConnections()
+	} else {
+		client, err := kvclient.New(kvclient.Config{Ports: PortsList, ClientID: ClientID, User: User, Secret: Secret, TLS: TLSConfig})
+		if err != nil {
+			log.Fatal(err)
+		}
+		Client = client
+	}
+	JSONOutput = *jsonOutput
 
-	go handleCLIInput()
+	if *execCommands != "" {
+		ok := true
+		for _, command := range strings.Split(*execCommands, ";") {
+			ok = execute(command, true) && ok
+		}
+		exit(ok)
+	}
+	runShell(*historyFile)
+}
 
+// runShell reads commands until the input ends. Commands run concurrently,
+// like requests from separate clients would, and the client waits for all
+// of them before exiting.
+func runShell(historyFile string) {
+	Shell = shell.New(shell.Config{Prompt: "> ", HistoryFile: historyFile, Complete: complete})
+	if Shell.Interactive() {
+		Output = Shell
+	}
 	for {
+		line, err := Shell.ReadLine()
+		if errors.Is(err, shell.ErrInterrupted) {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, "Error reading standard input:", err)
+			}
+			break
+		}
+		execute(line, false)
+	}
+	inflight.Wait()
+	exit(true)
+}
+
+// execute runs one command line and reports whether it succeeded. Server
+// commands run in the background unless wait is set. A "NOT FOUND" reply
+// counts as success; with the text protocol only errors the client detects
+// itself count as failures, since replies carry no status.
+func execute(line string, wait bool) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return true
+	}
+	name, args, _ := strings.Cut(line, " ")
+	args = strings.TrimSpace(args)
+	switch name {
+	case "help":
+		printHelp()
+		return true
+	case "history":
+		printHistory()
+		return true
+	case "setdelay":
+		return handleSetDelay(args)
+	case "batch":
+		return runBatch(args)
+	case "exit":
+		fmt.Fprintln(Output, "Exiting...")
+		exit(true)
+	}
+
+	request, err := validate(line)
+	if err != nil {
+		printResult(result{Command: line, Output: err.Error(), Error: true})
+		return false
+	}
+	if Protocol == wire.Text {
+		command := sendCommand(PortsList[0], line)
+		if !wait {
+			return true
+		}
+		return <-command.done
+	}
+	if !wait {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			runCommand(line, request)
+		}()
+		return true
 	}
+	return runCommand(line, request)
 }
 
-func handleCLIInput() {
-	scanner := bufio.NewScanner(os.Stdin)
+// validate checks a server command before it is sent, so mistakes are
+// reported with the command's usage instead of as a server error.
+func validate(line string) (wire.Message, error) {
+	request := wire.ParseText(ClientID + " " + line)
+	switch request.Op {
+	case wire.OpInsert, wire.OpLookup, wire.OpDictionary, wire.OpWatch, wire.OpUnwatch:
+		return request, nil
+	}
+	name, _, _ := strings.Cut(line, " ")
+	info, ok := lookupCommand(name)
+	if !ok {
+		return request, fmt.Errorf("unknown command %q, try help", name)
+	}
+	reason := request.Text
+	if reason == "" || reason == "error" {
+		reason = "wrong arguments"
+	}
+	return request, fmt.Errorf("%s: %s, usage: %s", name, reason, info.usage)
+}
+
+func lookupCommand(name string) (commandInfo, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return commandInfo{}, false
+}
+
+// runBatch runs the commands in path one at a time, each after the
+// previous one's reply, and reports whether all of them succeeded. Blank
+// lines and lines starting with # are skipped.
+func runBatch(path string) bool {
+	if path == "" {
+		printResult(result{Command: "batch", Output: "batch: missing file, usage: batch <file>", Error: true})
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		printResult(result{Command: "batch " + path, Output: err.Error(), Error: true})
+		return false
+	}
+	defer file.Close()
+
+	start := time.Now()
+	total, failed := 0, 0
+	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		command := scanner.Text()
-		switch command {
-		case "exit":
-			fmt.Println("Exiting...")
-			os.Exit(0)
-		default:
-			sendMessage(PortsList[0], command)
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		total++
+		if name, _, _ := strings.Cut(line, " "); name == "batch" {
+			printResult(result{Command: line, Output: "batch files cannot run other batch files", Error: true})
+			failed++
+			continue
+		}
+		if !execute(line, true) {
+			failed++
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading standard input:", err)
+		printResult(result{Command: "batch " + path, Output: err.Error(), Error: true})
+		return false
+	}
+	if !JSONOutput {
+		fmt.Fprintf(Output, "Batch %s: %d commands, %d failed in %s\n", path, total, failed, roundLatency(time.Since(start)))
 	}
+	return failed == 0
+}
+
+// complete offers command names for the first word and the keywords some
+// commands take after it.
+func complete(line string) []string {
+	words := strings.Fields(line)
+	current := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		current = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+	if len(words) == 0 {
+		var candidates []string
+		for _, c := range commands {
+			if strings.HasPrefix(c.name, current) {
+				candidates = append(candidates, c.name+" ")
+			}
+		}
+		return candidates
+	}
+
+	base := strings.Join(words, " ") + " "
+	var options []string
+	switch {
+	case words[0] == "batch" && len(words) == 1:
+		matches, _ := filepath.Glob(current + "*")
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				options = append(options, match+"/")
+			} else {
+				options = append(options, match+" ")
+			}
+		}
+	case (words[0] == "watch" || words[0] == "unwatch") && len(words) == 1:
+		options = []string{"prefix "}
+	case words[0] == "insert" && len(words) == 3:
+		options = []string{"ttl="}
+	case words[0] == "setdelay" && len(words) == 1:
+		options = []string{"constant:", "uniform:", "normal:", "pareto:", "matrix:"}
+	}
+	var candidates []string
+	for _, option := range options {
+		if strings.HasPrefix(option, current) {
+			candidates = append(candidates, base+option)
+		}
+	}
+	return candidates
+}
+
+func printHelp() {
+	for _, c := range commands {
+		fmt.Fprintf(Output, "  %-42s %s\n", c.usage, c.help)
+	}
+}
+
+func printHistory() {
+	if Shell == nil {
+		return
+	}
+	for i, line := range Shell.History() {
+		fmt.Fprintf(Output, "%5d  %s\n", i+1, line)
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".pa1_history")
+}
+
+// exit restores the terminal and saves the history before quitting.
+func exit(ok bool) {
+	if Client != nil {
+		Client.Close()
+	}
+	if Shell != nil {
+		if err := Shell.Close(); err != nil {
+			log.Printf("Error saving history: %v", err)
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
 
 func initalizeConnections() {
 	for _, port := range PortsList {
-		conn, err := net.Dial("tcp", ":"+port)
-		if err != nil {
-			log.Fatal("Address already in use: " + err.Error())
-		}
-		serverMap[port] = conn
+		serverMap[port] = dialServer(port)
 
 		sendMessage(port, "ping")
 		go listenForReponse(port)
 	}
 }
 
-func sendMessage(port string, message string) {
-	var conn net.Conn
+func getConnection(port string) *wire.Conn {
 	if _, ok := serverMap[port]; !ok {
-		conn, err := net.Dial("tcp", ":"+port)
-		if err != nil {
-			log.Fatal(err)
+		serverMap[port] = dialServer(port)
+	}
+	return serverMap[port]
+}
+
+func dialServer(port string) *wire.Conn {
+	netConn, err := tlsutil.Dial(port, 5*time.Second, TLSConfig)
+	if err != nil {
+		log.Fatal("Address already in use: " + err.Error())
+	}
+	conn := wire.NewConn(netConn, wire.Text)
+	if User != "" {
+		if err := auth.ClientHandshake(conn, User, Secret, ClientID); err != nil {
+			log.Fatalf("Error authenticating to %s: %v", port, err)
 		}
-		serverMap[port] = conn
 	}
+	return conn
+}
 
-	conn = serverMap[port]
+func sendMessage(port string, message string) {
+	conn := getConnection(port)
 
-	writer := bufio.NewWriter(conn)
-	writer.WriteString(fmt.Sprintf("%s %s\n", ClientID, message))
-	writer.Flush()
+	conn.WriteLine(fmt.Sprintf("%s %s", ClientID, message))
 }
 
-func listenForReponse(port string) {
-	var conn net.Conn
-	if _, ok := serverMap[port]; !ok {
-		conn, err := net.Dial("tcp", ":"+port)
-		if err != nil {
-			log.Fatal(err)
-		}
-		serverMap[port] = conn
+// sendCommand sends a command the server will answer and queues it for
+// listenForReponse to match with the reply.
+func sendCommand(port string, command string) *pendingCommand {
+	p := &pendingCommand{command: command, start: time.Now(), done: make(chan bool, 1)}
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if lost[port] {
+		printResult(result{Command: command, Port: port, Output: "error: connection lost", Error: true})
+		p.done <- false
+		return p
 	}
+	inflight.Add(1)
+	pending[port] = append(pending[port], p)
+	sendMessage(port, command)
+	return p
+}
 
-	conn = serverMap[port]
+func nextPending(port string) *pendingCommand {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if len(pending[port]) == 0 {
+		return nil
+	}
+	p := pending[port][0]
+	pending[port] = pending[port][1:]
+	return p
+}
+
+// failPending fails every command still waiting on port's lost connection.
+func failPending(port string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	lost[port] = true
+	for _, p := range pending[port] {
+		printResult(result{Command: p.command, Port: port, Output: "error: connection lost", Error: true})
+		p.done <- false
+		inflight.Done()
+	}
+	delete(pending, port)
+}
+
+func listenForReponse(port string) {
+	conn := getConnection(port)
 
-	reader := bufio.NewReader(conn)
 	for {
-		response, err := reader.ReadString('\n')
+		response, err := conn.ReadLine()
 		if err != nil {
 			log.Printf("Error reading from connection to port %s: %v", port, err)
+			failPending(port)
 			return
 		}
 
+		if message := wire.ParseText(response); message.Kind == wire.KindNotification {
+			go printNotification(port, message)
+			continue
+		}
+		p := nextPending(port)
+		if p == nil {
+			go printOutput(port, result{Output: strings.TrimSpace(response)}, time.Now())
+			continue
+		}
 		go func() {
-			time.Sleep(time.Duration(NetworkDelay) * time.Second)
-			trimmedResponse := strings.TrimSpace(response)
-			fmt.Printf("Output: %s\n", trimmedResponse)
+			printOutput(port, result{Command: p.command, Output: strings.TrimSpace(response)}, p.start)
+			p.done <- true
+			inflight.Done()
 		}()
 	}
 }
 
+// runCommand executes one validated command through the client library,
+// which routes it to the owning server, and reports whether it succeeded.
+func runCommand(command string, request wire.Message) bool {
+	start := time.Now()
+	ctx := context.Background()
+	port := PortsList[0]
+	if request.Op == wire.OpInsert || request.Op == wire.OpLookup {
+		port = kvclient.Owner(PortsList, request.Key)
+	}
+
+	var output string
+	var err error
+	switch request.Op {
+	case wire.OpInsert:
+		_, err = Client.InsertTTL(ctx, request.Key, request.Value, request.TTL)
+		output = "Success"
+	case wire.OpLookup:
+		var value int
+		value, err = Client.LookupAt(ctx, request.Key, request.Version)
+		output = strconv.Itoa(value)
+	case wire.OpDictionary:
+		output, err = Client.Dictionary(ctx, request.Version)
+	case wire.OpWatch:
+		err = startWatch(ctx, request)
+		output = "Watching"
+	case wire.OpUnwatch:
+		output = stopWatch(request)
+	}
+
+	var serverErr *kvclient.ServerError
+	switch {
+	case errors.Is(err, kvclient.ErrNotFound):
+		output, err = "NOT FOUND", nil
+	case errors.As(err, &serverErr):
+		output = serverErr.Message
+	case err != nil:
+		output = "error: " + err.Error()
+	}
+	printOutput(port, result{Command: command, Output: output, Error: err != nil}, start)
+	return err == nil
+}
+
+// startWatch opens a watch through the client library and prints its
+// events until it is closed with unwatch.
+func startWatch(ctx context.Context, request wire.Message) error {
+	var w *kvclient.Watch
+	var err error
+	if prefix, ok := strings.CutSuffix(request.Text, "*"); ok {
+		w, err = Client.WatchPrefix(ctx, prefix, request.Version)
+	} else {
+		w, err = Client.WatchKey(ctx, request.Key, request.Version)
+	}
+	if err != nil {
+		return err
+	}
+	watchMutex.Lock()
+	if old, ok := watches[request.Text]; ok {
+		old.Close()
+	}
+	watches[request.Text] = w
+	watchMutex.Unlock()
+
+	go func() {
+		for event := range w.Events() {
+			printNotification(PortsList[0], wire.Message{
+				Kind:    wire.KindNotification,
+				Key:     event.Key,
+				Value:   event.Value,
+				Version: event.Version,
+				Text:    w.Pattern(),
+			})
+		}
+	}()
+	return nil
+}
+
+func stopWatch(request wire.Message) string {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	w, ok := watches[request.Text]
+	if !ok {
+		return "NOT WATCHING"
+	}
+	w.Close()
+	delete(watches, request.Text)
+	return "Success"
+}
+
+func printNotification(port string, message wire.Message) {
+	latency.Sleep(port, "notify")
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if JSONOutput {
+		notification := notificationOutput{Watch: message.Text, Key: message.Key, Value: message.Value, Version: message.Version.String()}
+		if message.Status == wire.StatusError {
+			notification = notificationOutput{Error: message.Text}
+		}
+		encodeJSON(map[string]notificationOutput{"notify": notification})
+		return
+	}
+	if message.Status == wire.StatusError {
+		fmt.Fprintf(Output, "Notify: %s\n", message.Text)
+		return
+	}
+	fmt.Fprintf(Output, "Notify: key %d = %d @%s (watch %s)\n", message.Key, message.Value, message.Version, message.Text)
+}
+
+// printOutput prints a server's reply once the simulated delay has passed,
+// along with the time since start.
+func printOutput(port string, r result, start time.Time) {
+	latency.Sleep(port, "reply")
+	r.Port = port
+	r.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	printResult(r)
+}
+
+// printResult prints errors the client found itself, which have no port,
+// as "Error:" lines.
+func printResult(r result) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	switch {
+	case JSONOutput:
+		encodeJSON(r)
+	case r.Port == "":
+		fmt.Fprintf(Output, "Error: %s\n", r.Output)
+	default:
+		elapsed := time.Duration(r.LatencyMS * float64(time.Millisecond))
+		fmt.Fprintf(Output, "Output: %s (%s)\n", r.Output, roundLatency(elapsed))
+	}
+}
+
+// encodeJSON writes v on one line. Usage strings contain <, > and &, which
+// are left as they are.
+func encodeJSON(v any) {
+	encoder := json.NewEncoder(Output)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(10 * time.Microsecond)
+}
+
+func handleSetDelay(spec string) bool {
+	if spec == "" {
+		fmt.Fprintf(Output, "Delay model: %s\n", latency.Current())
+		return true
+	}
+	model, err := latency.Parse(spec)
+	if err != nil {
+		printResult(result{Command: "setdelay " + spec, Output: err.Error(), Error: true})
+		return false
+	}
+	latency.Set(model)
+	fmt.Fprintf(Output, "Delay model set to %s\n", model)
+	return true
+}
+
 func Initialize(ports string) {
-	ClientID = generateRandomString(5)
+	ClientID = kvclient.RandomID(5)
 	if ports == "" {
 		log.Fatal("Ports must be provided")
 	}
@@ -122,12 +688,3 @@ func Initialize(ports string) {
 		}
 	}
 }
-
-func generateRandomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyz"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
-	}
-	return string(b)
-}
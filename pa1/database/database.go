@@ -0,0 +1,153 @@
+package database
+
+import (
+	"pa1/logging"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Version struct {
+	Timestamp Timestamp
+	Value     int
+	// ExpiresAt is in Unix milliseconds; zero means the value never expires.
+	ExpiresAt int64
+}
+
+// DB keeps every version of a key, oldest first.
+var DB map[int][]Version
+var Mutex sync.RWMutex
+
+// Change is one committed version of a key.
+type Change struct {
+	Key     int
+	Version Version
+}
+
+// Committed, when set, is called for every insert while the write lock is
+// still held, so calls arrive in commit order. It must not block.
+var Committed func(change Change)
+
+func Initialize() {
+	DB = make(map[int][]Version)
+	rebuildTracking()
+}
+
+func Insert(key int, value int) (Timestamp, error) {
+	return InsertTTL(key, value, 0)
+}
+
+// InsertTTL stamps the write while holding the lock so version order always
+// matches commit order. The write is logged before it becomes visible. A
+// positive ttl makes the value expire that long after its timestamp. A
+// write that would not fit within MaxBytes even alone fails with
+// ErrTooLarge before it is logged. Once logged the write is committed, so a
+// failure to evict afterwards is only logged.
+func InsertTTL(key int, value int, ttl time.Duration) (Timestamp, error) {
+	Mutex.Lock()
+	defer Mutex.Unlock()
+	ts := HLC.Now()
+	record := logRecord{Op: opInsert, Key: key, Value: value, Timestamp: ts}
+	if ttl > 0 {
+		record.ExpiresAt = ts.Wall + ttl.Milliseconds()
+	}
+	if !fitsLocked(key, ts) {
+		return Timestamp{}, ErrTooLarge
+	}
+	if err := appendLog(record); err != nil {
+		return Timestamp{}, err
+	}
+	applyRecord(record)
+	touch(key)
+	if Committed != nil {
+		versions := DB[key]
+		Committed(Change{Key: key, Version: versions[len(versions)-1]})
+	}
+	if err := evictLocked(key); err != nil {
+		logging.Errorf("Error evicting after inserting key %d: %v", key, err)
+	}
+	return ts, nil
+}
+
+func Lookup(key int) (int, bool) {
+	Mutex.RLock()
+	defer Mutex.RUnlock()
+	versions := DB[key]
+	if len(versions) == 0 || expired(versions[len(versions)-1], nowMs()) {
+		return 0, false
+	}
+	touch(key)
+	return versions[len(versions)-1].Value, true
+}
+
+// LookupAt returns the newest value of key written at or before ts, unless
+// it had expired by ts.
+func LookupAt(key int, ts Timestamp) (int, bool) {
+	Mutex.RLock()
+	defer Mutex.RUnlock()
+	value, ok := valueAt(DB[key], ts)
+	if ok {
+		touch(key)
+	}
+	return value, ok
+}
+
+// Snapshot returns the dictionary as of ts. A zero ts means latest.
+func Snapshot(ts Timestamp) map[int]int {
+	Mutex.RLock()
+	defer Mutex.RUnlock()
+	result := make(map[int]int, len(DB))
+	now := nowMs()
+	for key, versions := range DB {
+		if ts.IsZero() {
+			if latest := versions[len(versions)-1]; !expired(latest, now) {
+				result[key] = latest.Value
+			}
+		} else if value, ok := valueAt(versions, ts); ok {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ChangesSince collects the versions of matching keys written after since,
+// oldest first, and hands them to then while writes are still blocked. A
+// watcher registered inside then therefore misses nothing committed after
+// the history it was given.
+func ChangesSince(since Timestamp, match func(key int) bool, then func(history []Change)) {
+	Mutex.RLock()
+	defer Mutex.RUnlock()
+	var history []Change
+	if !since.IsZero() {
+		for key, versions := range DB {
+			if !match(key) {
+				continue
+			}
+			for _, version := range versions {
+				if since.Before(version.Timestamp) {
+					history = append(history, Change{Key: key, Version: version})
+				}
+			}
+		}
+		sort.Slice(history, func(i, j int) bool {
+			return history[i].Version.Timestamp.Before(history[j].Version.Timestamp)
+		})
+	}
+	then(history)
+}
+
+func History(key int) []Version {
+	Mutex.RLock()
+	defer Mutex.RUnlock()
+	return append([]Version(nil), DB[key]...)
+}
+
+func valueAt(versions []Version, ts Timestamp) (int, bool) {
+	i := sort.Search(len(versions), func(i int) bool {
+		return ts.Before(versions[i].Timestamp)
+	})
+	if i == 0 || expired(versions[i-1], ts.Wall) {
+		return 0, false
+	}
+	return versions[i-1].Value, true
+}
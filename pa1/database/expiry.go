@@ -0,0 +1,310 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"pa1/logging"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Keys may carry an expiry time, and the store can be capped by key count or
+// by an estimate of its memory use. Expired and evicted keys are removed with
+// all of their versions, so time-travel reads of them stop working too.
+// Old versions of live keys are pruned by count and age, so a read far
+// enough back finds nothing.
+
+type EvictionPolicy int
+
+const (
+	LRU EvictionPolicy = iota
+	LFU
+)
+
+// Rough per-key and per-version costs used to estimate memory use.
+const keyOverhead = 64
+const versionSize = 32
+
+// ErrTooLarge rejects a write that the limits leave no room for even with
+// every other key evicted.
+var ErrTooLarge = errors.New("key does not fit within the memory limit")
+
+// Victims are chosen from a random sample of keys rather than the whole
+// dictionary, as Redis does, so an eviction costs the same at any size.
+const evictionSamples = 16
+
+type Limits struct {
+	// Zero means unlimited.
+	MaxKeys  int
+	MaxBytes int64
+	Policy   EvictionPolicy
+	// MaxVersions caps the versions kept per key, and versions superseded
+	// more than VersionRetention before a key's latest are dropped. Zero
+	// means unlimited; the latest version is always kept.
+	MaxVersions      int
+	VersionRetention time.Duration
+}
+
+type Usage struct {
+	Keys    int   `json:"keys"`
+	Bytes   int64 `json:"bytes"`
+	Expired int64 `json:"expired"`
+	Evicted int64 `json:"evicted"`
+	Pruned  int64 `json:"pruned_versions"`
+}
+
+type accessInfo struct {
+	lastUsed atomic.Int64
+	hits     atomic.Int64
+}
+
+// All guarded by Mutex, except that the fields of an accessInfo are updated
+// by readers holding only the read lock.
+var limits Limits
+var usedBytes int64
+var access = make(map[int]*accessInfo)
+
+var expiredCount atomic.Int64
+var evictedCount atomic.Int64
+var prunedCount atomic.Int64
+
+func (p EvictionPolicy) String() string {
+	if p == LFU {
+		return "lfu"
+	}
+	return "lru"
+}
+
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch strings.ToLower(name) {
+	case "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	}
+	return LRU, fmt.Errorf("unknown eviction policy %q, expected lru or lfu", name)
+}
+
+// SetLimits takes effect on the next insert, except that versions beyond
+// the new limits are pruned right away.
+func SetLimits(l Limits) {
+	Mutex.Lock()
+	defer Mutex.Unlock()
+	limits = l
+	for key := range DB {
+		pruneVersions(key)
+	}
+}
+
+func CurrentUsage() Usage {
+	Mutex.RLock()
+	defer Mutex.RUnlock()
+	return Usage{
+		Keys:    len(DB),
+		Bytes:   usedBytes,
+		Expired: expiredCount.Load(),
+		Evicted: evictedCount.Load(),
+		Pruned:  prunedCount.Load(),
+	}
+}
+
+func expired(version Version, atMs int64) bool {
+	return version.ExpiresAt != 0 && atMs >= version.ExpiresAt
+}
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+// touch records a use of key for eviction. Safe under the read lock.
+func touch(key int) {
+	if info := access[key]; info != nil {
+		info.lastUsed.Store(nowMs())
+		info.hits.Add(1)
+	}
+}
+
+// trackInsert and trackDelete keep the memory estimate and access table in
+// step with DB. They run from applyRecord, so replay rebuilds them too.
+func trackInsert(key int) {
+	if _, ok := access[key]; !ok {
+		info := &accessInfo{}
+		info.lastUsed.Store(nowMs())
+		access[key] = info
+		usedBytes += keyOverhead
+	}
+	usedBytes += versionSize
+}
+
+func trackDelete(key int, versions int) {
+	if _, ok := access[key]; ok {
+		delete(access, key)
+		usedBytes -= keyOverhead
+	}
+	usedBytes -= int64(versions) * versionSize
+}
+
+// pruneVersions drops the versions of key that are past the limits. It runs
+// from applyRecord, so replay prunes the same way. The slice is replaced
+// rather than shifted, since snapshots hold on to the old one.
+func pruneVersions(key int) {
+	versions := DB[key]
+	drop := prunable(versions)
+	if drop == 0 {
+		return
+	}
+	DB[key] = append([]Version(nil), versions[drop:]...)
+	usedBytes -= int64(drop) * versionSize
+	prunedCount.Add(int64(drop))
+}
+
+// prunable counts the oldest versions that are past the limits.
+func prunable(versions []Version) int {
+	drop := 0
+	if limits.MaxVersions > 0 && len(versions) > limits.MaxVersions {
+		drop = len(versions) - limits.MaxVersions
+	}
+	if limits.VersionRetention > 0 {
+		// Keep the version that was current at the cutoff, so reads at
+		// any time within the window still find it.
+		cutoff := versions[len(versions)-1].Timestamp.Wall - limits.VersionRetention.Milliseconds()
+		for drop+1 < len(versions) && versions[drop+1].Timestamp.Wall <= cutoff {
+			drop++
+		}
+	}
+	return drop
+}
+
+// fitsLocked reports whether key still fits within MaxBytes on its own
+// once a version stamped ts is added and the versions past the limits are
+// pruned. Must be called with Mutex held.
+func fitsLocked(key int, ts Timestamp) bool {
+	if limits.MaxBytes <= 0 {
+		return true
+	}
+	// The full slice expression makes append copy rather than write into
+	// a backing array that snapshots may share.
+	versions := DB[key]
+	versions = append(versions[:len(versions):len(versions)], Version{Timestamp: ts})
+	kept := len(versions) - prunable(versions)
+	return keyOverhead+int64(kept)*versionSize <= limits.MaxBytes
+}
+
+// rebuildTracking recomputes the accounting after DB is replaced wholesale by
+// a snapshot.
+func rebuildTracking() {
+	access = make(map[int]*accessInfo, len(DB))
+	usedBytes = 0
+	for key, versions := range DB {
+		for range versions {
+			trackInsert(key)
+		}
+	}
+}
+
+// deleteLocked logs and applies the removal of key. Must be called with
+// Mutex held for writing.
+func deleteLocked(key int) error {
+	record := logRecord{Op: opDelete, Key: key, Timestamp: HLC.Now()}
+	if err := appendLog(record); err != nil {
+		return err
+	}
+	applyRecord(record)
+	return nil
+}
+
+func overLimitLocked() bool {
+	return (limits.MaxKeys > 0 && len(DB) > limits.MaxKeys) ||
+		(limits.MaxBytes > 0 && usedBytes > limits.MaxBytes)
+}
+
+// evictLocked removes keys until the store is back under its limits. The key
+// just written is never evicted; InsertTTL refuses a write that could not
+// fit alone. Must be called with Mutex held for writing.
+func evictLocked(keep int) error {
+	for overLimitLocked() {
+		victim, ok := victimLocked(keep)
+		if !ok {
+			return nil
+		}
+		if err := deleteLocked(victim); err != nil {
+			return err
+		}
+		evictedCount.Add(1)
+		logging.Debugf("Evicted key %d (%s)", victim, limits.Policy)
+	}
+	return nil
+}
+
+func victimLocked(keep int) (int, bool) {
+	now := nowMs()
+	victim, found := 0, false
+	var best *accessInfo
+	sampled := 0
+	for key, versions := range DB {
+		if key == keep {
+			continue
+		}
+		// Anything already expired goes first.
+		if expired(versions[len(versions)-1], now) {
+			return key, true
+		}
+		info := access[key]
+		if !found || colder(info, best) {
+			victim, best, found = key, info, true
+		}
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+	return victim, found
+}
+
+func colder(a, b *accessInfo) bool {
+	if limits.Policy == LFU {
+		if a.hits.Load() != b.hits.Load() {
+			return a.hits.Load() < b.hits.Load()
+		}
+	}
+	return a.lastUsed.Load() < b.lastUsed.Load()
+}
+
+// ExpireKeys removes every key whose latest version has expired and returns
+// how many were removed.
+func ExpireKeys() (int, error) {
+	Mutex.Lock()
+	defer Mutex.Unlock()
+	now := nowMs()
+	count := 0
+	for key, versions := range DB {
+		if !expired(versions[len(versions)-1], now) {
+			continue
+		}
+		if err := deleteLocked(key); err != nil {
+			return count, err
+		}
+		expiredCount.Add(1)
+		count++
+	}
+	return count, nil
+}
+
+// StartExpiry sweeps expired keys every interval. Reads already hide expired
+// values; the sweep is what frees their memory.
+func StartExpiry(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			count, err := ExpireKeys()
+			if err != nil {
+				logging.Errorf("Error expiring keys: %v", err)
+			} else if count > 0 {
+				logging.Debugf("Expired %d keys", count)
+			}
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInsertThatCannotFitIsRejected(t *testing.T) {
+	openEmpty(t)
+	SetLimits(Limits{MaxBytes: keyOverhead + versionSize})
+	t.Cleanup(func() { SetLimits(Limits{}) })
+
+	mustInsert(t, 1, 10)
+	// A second version of key 1 is over the limit with nothing else to
+	// evict.
+	if _, err := Insert(1, 11); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Insert of a version that cannot fit = %v, want ErrTooLarge", err)
+	}
+	if value, ok := Lookup(1); !ok || value != 10 {
+		t.Errorf("Lookup(1) after the rejected write = %d, %t, want 10, true", value, ok)
+	}
+	if history := History(1); len(history) != 1 {
+		t.Errorf("History(1) = %v, want the one version", history)
+	}
+
+	// Once old versions are pruned the key fits again.
+	SetLimits(Limits{MaxBytes: keyOverhead + versionSize, MaxVersions: 1})
+	mustInsert(t, 1, 11)
+
+	// The key just written is never the one evicted.
+	mustInsert(t, 2, 20)
+	if _, ok := Lookup(1); ok {
+		t.Error("key 1 was kept over the limit")
+	}
+	if value, ok := Lookup(2); !ok || value != 20 {
+		t.Errorf("Lookup(2) = %d, %t, want 20, true", value, ok)
+	}
+	if usage := CurrentUsage(); usage.Keys != 1 || usage.Bytes > keyOverhead+versionSize {
+		t.Errorf("usage after eviction = %+v, want one key within the limit", usage)
+	}
+}
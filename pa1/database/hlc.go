@@ -0,0 +1,122 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading: wall time in milliseconds plus
+// a logical counter to order events within the same millisecond.
+type Timestamp struct {
+	Wall    int64
+	Logical int32
+}
+
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+func (t Timestamp) Before(other Timestamp) bool {
+	if t.Wall != other.Wall {
+		return t.Wall < other.Wall
+	}
+	return t.Logical < other.Logical
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.Wall, t.Logical)
+}
+
+// ParseTimestamp accepts "<wall>.<logical>" or a bare "<wall>".
+func ParseTimestamp(s string) (Timestamp, error) {
+	s = strings.TrimPrefix(s, "@")
+	wallPart, logicalPart, hasLogical := strings.Cut(s, ".")
+	wall, err := strconv.ParseInt(wallPart, 10, 64)
+	if err != nil || wall < 0 {
+		return Timestamp{}, fmt.Errorf("invalid version %q", s)
+	}
+	ts := Timestamp{Wall: wall}
+	if hasLogical {
+		logical, err := strconv.ParseInt(logicalPart, 10, 32)
+		if err != nil || logical < 0 {
+			return Timestamp{}, fmt.Errorf("invalid version %q", s)
+		}
+		ts.Logical = int32(logical)
+	}
+	return ts, nil
+}
+
+// MaxOffset bounds how far ahead of our physical clock a version from
+// elsewhere may be. Anything further is a client's guess or a broken clock,
+// and taking it would push every later write out with it.
+const MaxOffset = 500 * time.Millisecond
+
+var ErrFutureVersion = errors.New("version is in the future")
+
+// CheckOffset rejects ts if it is more than MaxOffset ahead of physical time.
+func CheckOffset(ts Timestamp) error {
+	if time.Duration(ts.Wall-time.Now().UnixMilli())*time.Millisecond > MaxOffset {
+		return ErrFutureVersion
+	}
+	return nil
+}
+
+type Clock struct {
+	mu   sync.Mutex
+	last Timestamp
+}
+
+var HLC = &Clock{}
+
+// Now returns a timestamp strictly greater than any previously issued or
+// observed by this clock.
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := time.Now().UnixMilli()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// WaitPast blocks until physical time is past ts, so that every write
+// stamped afterwards lands after it, without moving the clock. Reads use it
+// rather than Update, so a read can never push the clock forward.
+func (c *Clock) WaitPast(ts Timestamp) error {
+	if err := CheckOffset(ts); err != nil {
+		return err
+	}
+	if ahead := ts.Wall - time.Now().UnixMilli(); ahead >= 0 {
+		time.Sleep(time.Duration(ahead+1) * time.Millisecond)
+	}
+	return nil
+}
+
+// Update merges a timestamp received from a peer so that later local events
+// are ordered after it.
+func (c *Clock) Update(remote Timestamp) Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := time.Now().UnixMilli()
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+	return c.last
+}
@@ -0,0 +1,404 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"pa1/logging"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Records are framed as [length uint32][crc32c uint32][payload] so a torn
+// write at the tail of the log can be detected and discarded on recovery.
+
+const (
+	opInsert byte = 1
+	// opDelete drops a key and all its versions, for expiry and eviction.
+	opDelete byte = 2
+)
+
+const frameHeaderSize = 8
+const recordSize = 1 + 8 + 8 + 8 + 4 + 8
+const snapshotFile = "snapshot.db"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errTornFrame = errors.New("torn or corrupt log frame")
+
+type logRecord struct {
+	Op        byte
+	Key       int
+	Value     int
+	Timestamp Timestamp
+	ExpiresAt int64
+}
+
+type snapshotState struct {
+	Segment int
+	Clock   Timestamp
+	Data    map[int][]Version
+}
+
+type WAL struct {
+	dir     string
+	segment int
+	file    *os.File
+	writer  *bufio.Writer
+	sync    bool
+}
+
+// Log is nil when the server runs without a data directory.
+var Log *WAL
+var snapshotMutex sync.Mutex
+
+func (r logRecord) encode() []byte {
+	buf := make([]byte, recordSize)
+	buf[0] = r.Op
+	binary.LittleEndian.PutUint64(buf[1:], uint64(r.Key))
+	binary.LittleEndian.PutUint64(buf[9:], uint64(r.Value))
+	binary.LittleEndian.PutUint64(buf[17:], uint64(r.Timestamp.Wall))
+	binary.LittleEndian.PutUint32(buf[25:], uint32(r.Timestamp.Logical))
+	binary.LittleEndian.PutUint64(buf[29:], uint64(r.ExpiresAt))
+	return buf
+}
+
+func decodeRecord(buf []byte) (logRecord, error) {
+	if len(buf) != recordSize {
+		return logRecord{}, fmt.Errorf("bad record size %d", len(buf))
+	}
+	record := logRecord{
+		Op:    buf[0],
+		Key:   int(int64(binary.LittleEndian.Uint64(buf[1:]))),
+		Value: int(int64(binary.LittleEndian.Uint64(buf[9:]))),
+		Timestamp: Timestamp{
+			Wall:    int64(binary.LittleEndian.Uint64(buf[17:])),
+			Logical: int32(binary.LittleEndian.Uint32(buf[25:])),
+		},
+		ExpiresAt: int64(binary.LittleEndian.Uint64(buf[29:])),
+	}
+	return record, nil
+}
+
+func writeFrame(w io.Writer, payload []byte) error {
+	header := make([]byte, frameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame returns io.EOF at a clean end of input and errTornFrame when the
+// remaining bytes do not form a complete, valid frame.
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errTornFrame
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	if length > 1<<30 {
+		return nil, errTornFrame
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errTornFrame
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, errTornFrame
+	}
+	return payload, nil
+}
+
+func segmentName(segment int) string {
+	return fmt.Sprintf("wal-%06d.log", segment)
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// Open restores DB from the snapshot and log in dir, then starts a fresh log
+// segment for new writes. Must be called after Initialize.
+func Open(dir string, sync bool) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	Mutex.Lock()
+	defer Mutex.Unlock()
+
+	covered, err := loadSnapshot(dir)
+	if err != nil {
+		return err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	last := covered
+	replayed := 0
+	for i, segment := range segments {
+		if segment <= covered {
+			continue
+		}
+		n, err := replaySegment(dir, segment, i == len(segments)-1)
+		if err != nil {
+			return err
+		}
+		replayed += n
+		last = segment
+	}
+
+	wal := &WAL{dir: dir, segment: last, sync: sync}
+	if err := wal.rotate(); err != nil {
+		return err
+	}
+	Log = wal
+	logging.Infof("Recovered %d keys from %s (%d log records replayed)", len(DB), dir, replayed)
+	return nil
+}
+
+func loadSnapshot(dir string) (int, error) {
+	file, err := os.Open(filepath.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	payload, err := readFrame(bufio.NewReader(file))
+	if err != nil {
+		return 0, fmt.Errorf("reading snapshot: %w", err)
+	}
+	var state snapshotState
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&state); err != nil {
+		return 0, fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if state.Data != nil {
+		DB = state.Data
+		rebuildTracking()
+	}
+	HLC.Update(state.Clock)
+	return state.Segment, nil
+}
+
+// replaySegment applies every intact record in a segment. A torn tail is only
+// tolerated on the newest segment, where it is truncated away.
+func replaySegment(dir string, segment int, newest bool) (int, error) {
+	path := filepath.Join(dir, segmentName(segment))
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	count := 0
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err == errTornFrame {
+			if !newest {
+				return count, fmt.Errorf("%s: corrupt record at offset %d", path, offset)
+			}
+			logging.Warnf("Truncating torn tail of %s at offset %d", path, offset)
+			return count, file.Truncate(offset)
+		}
+		record, err := decodeRecord(payload)
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", path, err)
+		}
+		applyRecord(record)
+		offset += int64(frameHeaderSize + len(payload))
+		count++
+	}
+}
+
+func applyRecord(record logRecord) {
+	switch record.Op {
+	case opInsert:
+		DB[record.Key] = append(DB[record.Key], Version{Timestamp: record.Timestamp, Value: record.Value, ExpiresAt: record.ExpiresAt})
+		trackInsert(record.Key)
+		pruneVersions(record.Key)
+	case opDelete:
+		trackDelete(record.Key, len(DB[record.Key]))
+		delete(DB, record.Key)
+	}
+	HLC.Update(record.Timestamp)
+}
+
+// appendLog must be called with Mutex held for writing.
+func appendLog(record logRecord) error {
+	if Log == nil {
+		return nil
+	}
+	if err := writeFrame(Log.writer, record.encode()); err != nil {
+		return err
+	}
+	if err := Log.writer.Flush(); err != nil {
+		return err
+	}
+	if Log.sync {
+		return Log.file.Sync()
+	}
+	return nil
+}
+
+func (w *WAL) rotate() error {
+	if w.file != nil {
+		if err := w.writer.Flush(); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.file.Close()
+	}
+	w.segment++
+	file, err := os.OpenFile(filepath.Join(w.dir, segmentName(w.segment)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// TakeSnapshot writes the full versioned dictionary to disk and compacts the
+// log segments it covers. Writers are only blocked while the log rotates.
+func TakeSnapshot() error {
+	if Log == nil {
+		return errors.New("persistence is disabled")
+	}
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	Mutex.Lock()
+	state := snapshotState{
+		Clock: HLC.Now(),
+		Data:  make(map[int][]Version, len(DB)),
+	}
+	// Version slices are only appended to or replaced, never changed in
+	// place, so copying the headers is enough to freeze what the snapshot
+	// sees.
+	for key, versions := range DB {
+		state.Data[key] = versions
+	}
+	state.Segment = Log.segment
+	err := Log.rotate()
+	Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(state); err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(Log.dir, snapshotFile+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(file, payload.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tmpPath, filepath.Join(Log.dir, snapshotFile)); err != nil {
+		return err
+	}
+	// The rename must be durable before the segments it replaces are gone,
+	// or a crash could leave neither.
+	if err := syncDir(Log.dir); err != nil {
+		return err
+	}
+
+	segments, err := listSegments(Log.dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment <= state.Segment {
+			os.Remove(filepath.Join(Log.dir, segmentName(segment)))
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func StartSnapshots(interval time.Duration) {
+	if Log == nil || interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := TakeSnapshot(); err != nil {
+				logging.Errorf("Error taking snapshot: %v", err)
+			}
+		}
+	}()
+}
+
+func Close() {
+	Mutex.Lock()
+	defer Mutex.Unlock()
+	if Log == nil {
+		return
+	}
+	Log.writer.Flush()
+	Log.file.Sync()
+	Log.file.Close()
+	Log = nil
+}
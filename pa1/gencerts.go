@@ -0,0 +1,176 @@
+//go:build ignore
+
+// Run with: go run gencerts.go -out certs
+//
+// Generates a CA and certificates for a local cluster: server.pem for the
+// servers (usable for both ends of links between them) and one certificate
+// per client name. An existing CA in the output directory is reused, so
+// running this again rotates the leaf certificates without touching the CA;
+// servers pick the new files up on their next reload.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Must match tlsutil.ServerUnit.
+const serverUnit = "pa1-server"
+
+func main() {
+	out := flag.String("out", "certs", "Directory to write PEM files to")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "Comma-separated host names and IPs for the server certificate")
+	clients := flag.String("clients", "client", "Comma-separated client names, one certificate each")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "Validity of the leaf certificates")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	caCert, caKey, err := loadOrCreateCA(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "pa1 server", OrganizationalUnit: []string{serverUnit}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else if host != "" {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if err := issue(*out, "server", server, *validFor, caCert, caKey); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range strings.Split(*clients, ",") {
+		if name == "" {
+			continue
+		}
+		client := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name, OrganizationalUnit: []string{"pa1-client"}},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if err := issue(*out, name, client, *validFor, caCert, caKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Wrote certificates to %s\n", *out)
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, certErr := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	keyPEM, keyErr := os.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, nil, errors.New("ca.pem or ca-key.pem is not PEM")
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "pa1 local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(dir, "ca", der, key); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func issue(dir string, name string, template *x509.Certificate, validFor time.Duration, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template.SerialNumber = serial()
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validFor)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writePEM(dir, name, der, key)
+}
+
+// writePEM writes <name>.pem and <name>-key.pem, each through a rename so a
+// reloading server never reads a half-written file.
+func writePEM(dir string, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		path  string
+		block *pem.Block
+		mode  os.FileMode
+	}{
+		{filepath.Join(dir, name+"-key.pem"), &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}, 0o600},
+		{filepath.Join(dir, name+".pem"), &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0o644},
+	}
+	for _, f := range files {
+		tmp := f.path + ".tmp"
+		if err := os.WriteFile(tmp, pem.EncodeToMemory(f.block), f.mode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
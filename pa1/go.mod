@@ -0,0 +1,3 @@
+module pa1
+
+go 1.22.3
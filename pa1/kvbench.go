@@ -0,0 +1,476 @@
+//go:build ignore
+
+// Run with: go run kvbench.go -ports "9000,9001"
+//
+// The servers must use the binary protocol, the default; make bench-primary
+// and bench-secondary start them that way. Start them with -delay constant:0
+// unless the simulated network delay is what you want to measure.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"pa1/kvclient"
+	"pa1/tlsutil"
+	"pa1/wire"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram bucket upper bounds in milliseconds. The last bucket is +Inf.
+var bucketBounds = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+type Options struct {
+	Ports        []string      `json:"ports"`
+	Duration     time.Duration `json:"duration_ns"`
+	Concurrency  int           `json:"concurrency"`
+	Keys         int           `json:"keys"`
+	Distribution string        `json:"distribution"`
+	ZipfS        float64       `json:"zipf_s"`
+	ReadRatio    float64       `json:"read_ratio"`
+	Route        string        `json:"route"`
+	PoolSize     int           `json:"pool_size"`
+	Preload      bool          `json:"preload"`
+}
+
+type OpReport struct {
+	Op       string `json:"op"`
+	Requests int    `json:"requests"`
+	Errors   int    `json:"errors"`
+	// Timeouts counts requests still in flight when the run ended. They
+	// are not errors and have no latency.
+	Timeouts  int     `json:"timeouts"`
+	NotFound  int     `json:"not_found"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	MeanMs    float64 `json:"mean_ms"`
+	P50Ms     float64 `json:"p50_ms"`
+	P90Ms     float64 `json:"p90_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+	MaxMs     float64 `json:"max_ms"`
+	// Histogram[i] counts requests at or under bucketBounds[i]; the extra
+	// last entry counts the rest.
+	Histogram []int `json:"histogram"`
+}
+
+type Report struct {
+	Options      Options     `json:"options"`
+	Elapsed      float64     `json:"elapsed_sec"`
+	Buckets      []float64   `json:"bucket_bounds_ms"`
+	Ops          []*OpReport `json:"ops"`
+	FirstErrors  []string    `json:"first_errors,omitempty"`
+	errorsLogged map[string]bool
+}
+
+// result is one request as seen by a worker.
+type result struct {
+	op       string
+	latency  time.Duration
+	err      error
+	notFound bool
+	timedOut bool
+}
+
+func main() {
+	ports := flag.String("ports", "", "Comma-separated list of ports, primary first")
+	duration := flag.Duration("duration", 10*time.Second, "How long to run the load")
+	concurrency := flag.Int("concurrency", 16, "Number of concurrent request loops")
+	keys := flag.Int("keys", 1000, "Size of the key space")
+	distribution := flag.String("dist", "uniform", "Key distribution: uniform or zipf")
+	zipfS := flag.Float64("zipf-s", 1.1, "Zipf skew, must be greater than 1")
+	readRatio := flag.Float64("reads", 0.5, "Fraction of requests that are lookups")
+	route := flag.String("route", "owner", "Routing: owner sends each key to its server, leader sends everything to the primary")
+	poolSize := flag.Int("pool", 4, "Connections per server")
+	preload := flag.Bool("preload", false, "Insert every key once before measuring")
+	format := flag.String("format", "text", "Report format: text, csv or json")
+	out := flag.String("out", "", "File to write the report to, stdout if empty")
+	user := flag.String("user", "", "Name to authenticate as, for servers started with -auth")
+	secret := flag.String("secret", os.Getenv("PA1_SECRET"), "Secret for -user, defaults to $PA1_SECRET")
+	tlsCA := flag.String("tls-ca", "", "PEM CA to verify servers with; connects over TLS when set")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate, for servers that require one")
+	tlsKey := flag.String("tls-key", "", "PEM key for -tls-cert")
+	tlsServerName := flag.String("tls-server-name", "localhost", "Name the servers' certificates must be valid for")
+	flag.Parse()
+
+	if *ports == "" {
+		log.Fatal("Please provide ports using the -ports flag")
+	}
+	options := Options{
+		Ports:        strings.Split(*ports, ","),
+		Duration:     *duration,
+		Concurrency:  *concurrency,
+		Keys:         *keys,
+		Distribution: *distribution,
+		ZipfS:        *zipfS,
+		ReadRatio:    *readRatio,
+		Route:        *route,
+		PoolSize:     *poolSize,
+		Preload:      *preload,
+	}
+	if err := validate(options); err != nil {
+		log.Fatal(err)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCA != "" || *tlsCert != "" {
+		reloader, err := tlsutil.NewReloader(tlsutil.Config{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA, ServerName: *tlsServerName})
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig = reloader.ClientConfig()
+	}
+
+	clientID := "bench-" + kvclient.RandomID(5)
+	if *user != "" {
+		// Authenticated client IDs must start with the user name.
+		clientID = *user + "-" + clientID
+	}
+	client, err := kvclient.New(kvclient.Config{
+		Ports:    options.Ports,
+		ClientID: clientID,
+		PoolSize: options.PoolSize,
+		User:     *user,
+		Secret:   *secret,
+		TLS:      tlsConfig,
+		// A retried request would hide the latency we are trying to measure.
+		MaxRetries: -1,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	if options.Preload {
+		log.Printf("Preloading %d keys", options.Keys)
+		if err := preloadKeys(client, options); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Printf("Running %s over %d keys, %.0f%% reads, %d loops for %s",
+		options.Distribution, options.Keys, options.ReadRatio*100, options.Concurrency, options.Duration)
+	report := run(client, options)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "text":
+		err = writeText(w, report)
+	case "csv":
+		err = writeCSV(w, report)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// A run where nothing succeeded measured nothing, most likely servers
+	// that are down or speak the text protocol.
+	all := report.Ops[len(report.Ops)-1]
+	if all.Requests-all.Errors-all.Timeouts == 0 {
+		log.Fatalf("No request completed in %s; are the servers up and using the binary protocol?", options.Duration)
+	}
+}
+
+func validate(options Options) error {
+	if len(options.Ports) < 2 {
+		return fmt.Errorf("need a primary and a secondary port, got %v", options.Ports)
+	}
+	if options.Keys <= 0 {
+		return errors.New("-keys must be positive")
+	}
+	if options.Concurrency <= 0 {
+		return errors.New("-concurrency must be positive")
+	}
+	if options.ReadRatio < 0 || options.ReadRatio > 1 {
+		return errors.New("-reads must be between 0 and 1")
+	}
+	switch options.Distribution {
+	case "uniform":
+	case "zipf":
+		if options.ZipfS <= 1 {
+			return errors.New("-zipf-s must be greater than 1")
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q, expected uniform or zipf", options.Distribution)
+	}
+	if options.Route != "owner" && options.Route != "leader" {
+		return fmt.Errorf("unknown route %q, expected owner or leader", options.Route)
+	}
+	return nil
+}
+
+// keyGenerator returns a function drawing keys in [0, keys). Each loop gets
+// its own generator because rand.Rand is not safe for concurrent use.
+func keyGenerator(options Options, seed int64) func() int {
+	r := rand.New(rand.NewSource(seed))
+	if options.Distribution == "zipf" {
+		zipf := rand.NewZipf(r, options.ZipfS, 1, uint64(options.Keys-1))
+		return func() int { return int(zipf.Uint64()) }
+	}
+	return func() int { return r.Intn(options.Keys) }
+}
+
+func portFor(options Options, key int) string {
+	if options.Route == "leader" {
+		return options.Ports[0]
+	}
+	return kvclient.Owner(options.Ports, key)
+}
+
+func preloadKeys(client *kvclient.Client, options Options) error {
+	keys := make(chan int)
+	errs := make(chan error, options.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				request := wire.Message{Kind: wire.KindRequest, Op: wire.OpInsert, Key: key, Value: key}
+				if _, err := client.Do(context.Background(), portFor(options, key), request); err != nil {
+					errs <- fmt.Errorf("preloading key %d: %w", key, err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		for key := 0; key < options.Keys; key++ {
+			keys <- key
+		}
+		close(keys)
+	}()
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func run(client *kvclient.Client, options Options) *Report {
+	ctx, cancel := context.WithTimeout(context.Background(), options.Duration)
+	defer cancel()
+
+	results := make([][]result, options.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nextKey := keyGenerator(options, start.UnixNano()+int64(i))
+			r := rand.New(rand.NewSource(start.UnixNano() - int64(i)))
+			for ctx.Err() == nil {
+				key := nextKey()
+				request := wire.Message{Kind: wire.KindRequest, Op: wire.OpInsert, Key: key, Value: r.Intn(1 << 20)}
+				if r.Float64() < options.ReadRatio {
+					request = wire.Message{Kind: wire.KindRequest, Op: wire.OpLookup, Key: key}
+				}
+				sent := time.Now()
+				_, err := client.Do(ctx, portFor(options, key), request)
+				res := result{op: request.Op.String(), latency: time.Since(sent)}
+				if err != nil && ctx.Err() != nil {
+					// Cut off by the end of the run. Dropping these would
+					// hide requests slower than what was left of it.
+					results[i] = append(results[i], result{op: res.op, timedOut: true})
+					return
+				}
+				if errors.Is(err, kvclient.ErrNotFound) {
+					res.notFound = true
+				} else {
+					res.err = err
+				}
+				results[i] = append(results[i], res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return summarize(options, results, time.Since(start))
+}
+
+func summarize(options Options, results [][]result, elapsed time.Duration) *Report {
+	report := &Report{
+		Options:      options,
+		Elapsed:      elapsed.Seconds(),
+		Buckets:      bucketBounds,
+		errorsLogged: make(map[string]bool),
+	}
+	latencies := make(map[string][]time.Duration)
+	byOp := make(map[string]*OpReport)
+	total := &OpReport{Op: "all", Histogram: make([]int, len(bucketBounds)+1)}
+	for _, loop := range results {
+		for _, res := range loop {
+			op, ok := byOp[res.op]
+			if !ok {
+				op = &OpReport{Op: res.op, Histogram: make([]int, len(bucketBounds)+1)}
+				byOp[res.op] = op
+			}
+			if res.timedOut {
+				op.Requests++
+				op.Timeouts++
+				total.Requests++
+				total.Timeouts++
+				continue
+			}
+			for _, r := range []*OpReport{op, total} {
+				r.Requests++
+				if res.notFound {
+					r.NotFound++
+				}
+				if res.err != nil {
+					r.Errors++
+				}
+				r.Histogram[bucketFor(res.latency)]++
+			}
+			latencies[res.op] = append(latencies[res.op], res.latency)
+			latencies["all"] = append(latencies["all"], res.latency)
+			if res.err != nil && len(report.FirstErrors) < 10 && !report.errorsLogged[res.err.Error()] {
+				report.errorsLogged[res.err.Error()] = true
+				report.FirstErrors = append(report.FirstErrors, res.err.Error())
+			}
+		}
+	}
+
+	names := make([]string, 0, len(byOp))
+	for name := range byOp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Ops = append(report.Ops, byOp[name])
+	}
+	report.Ops = append(report.Ops, total)
+
+	for _, op := range report.Ops {
+		sorted := latencies[op.Op]
+		if len(sorted) == 0 {
+			continue
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		var sum time.Duration
+		for _, d := range sorted {
+			sum += d
+		}
+		op.OpsPerSec = float64(op.Requests-op.Timeouts) / elapsed.Seconds()
+		op.MeanMs = ms(sum / time.Duration(len(sorted)))
+		op.P50Ms = ms(percentile(sorted, 0.50))
+		op.P90Ms = ms(percentile(sorted, 0.90))
+		op.P99Ms = ms(percentile(sorted, 0.99))
+		op.MaxMs = ms(sorted[len(sorted)-1])
+	}
+	return report
+}
+
+func bucketFor(d time.Duration) int {
+	value := ms(d)
+	for i, bound := range bucketBounds {
+		if value <= bound {
+			return i
+		}
+	}
+	return len(bucketBounds)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(float64(len(sorted))*p)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func bucketLabel(i int) string {
+	if i == len(bucketBounds) {
+		return "inf"
+	}
+	return strconv.FormatFloat(bucketBounds[i], 'f', -1, 64) + "ms"
+}
+
+func writeText(w io.Writer, report *Report) error {
+	fmt.Fprintf(w, "Ran for %.1fs with %d loops, %s keys (%d), %.0f%% reads, route %s\n",
+		report.Elapsed, report.Options.Concurrency, report.Options.Distribution, report.Options.Keys,
+		report.Options.ReadRatio*100, report.Options.Route)
+	fmt.Fprintf(w, "%-10s %9s %7s %9s %9s %10s %9s %9s %9s %9s %9s\n",
+		"op", "requests", "errors", "timeouts", "notfound", "ops/sec", "mean", "p50", "p90", "p99", "max")
+	for _, op := range report.Ops {
+		fmt.Fprintf(w, "%-10s %9d %7d %9d %9d %10.1f %7.2fms %7.2fms %7.2fms %7.2fms %7.2fms\n",
+			op.Op, op.Requests, op.Errors, op.Timeouts, op.NotFound, op.OpsPerSec, op.MeanMs, op.P50Ms, op.P90Ms, op.P99Ms, op.MaxMs)
+	}
+
+	all := report.Ops[len(report.Ops)-1]
+	fmt.Fprintln(w, "\nLatency histogram (all ops):")
+	for i, count := range all.Histogram {
+		if count == 0 {
+			continue
+		}
+		bar := 0
+		if all.Requests > 0 {
+			bar = count * 50 / all.Requests
+		}
+		fmt.Fprintf(w, "  <= %-7s %9d %s\n", bucketLabel(i), count, strings.Repeat("#", bar))
+	}
+	for _, err := range report.FirstErrors {
+		fmt.Fprintf(w, "Error: %s\n", err)
+	}
+	return nil
+}
+
+// writeCSV writes one row per op with the histogram buckets as trailing
+// columns, so runs can be pasted side by side in a spreadsheet.
+func writeCSV(w io.Writer, report *Report) error {
+	cw := csv.NewWriter(w)
+	header := []string{"op", "requests", "errors", "timeouts", "not_found", "ops_per_sec", "mean_ms", "p50_ms", "p90_ms", "p99_ms", "max_ms"}
+	for i := range bucketBounds {
+		header = append(header, "le_"+bucketLabel(i))
+	}
+	header = append(header, "le_inf")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, op := range report.Ops {
+		row := []string{
+			op.Op, strconv.Itoa(op.Requests), strconv.Itoa(op.Errors), strconv.Itoa(op.Timeouts), strconv.Itoa(op.NotFound),
+			f(op.OpsPerSec), f(op.MeanMs), f(op.P50Ms), f(op.P90Ms), f(op.P99Ms), f(op.MaxMs),
+		}
+		for _, count := range op.Histogram {
+			row = append(row, strconv.Itoa(count))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
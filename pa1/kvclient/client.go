@@ -0,0 +1,249 @@
+// Package kvclient is a Go client for the pa1 key-value servers. It sends
+// each key straight to the server that owns it, pipelines requests over a
+// small pool of connections per server and retries transport failures.
+package kvclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"pa1/auth"
+	"pa1/database"
+	"pa1/wire"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+var ErrClosed = errors.New("client closed")
+
+// ServerError is an error reply from a server. It is never retried.
+type ServerError struct {
+	Port    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server %s: %s", e.Port, e.Message)
+}
+
+type Config struct {
+	// Ports lists the primary first and the secondary second, the same
+	// order as the -ports flag.
+	Ports          []string
+	ClientID       string
+	PoolSize       int
+	DialTimeout    time.Duration
+	RequestTimeout time.Duration
+	// MaxRetries defaults to 3; set it negative to disable retries.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// User and Secret authenticate to servers started with -auth. The
+	// client ID defaults to User, since servers only accept client IDs
+	// that start with the authenticated name.
+	User   string
+	Secret string
+	// TLS, when set, encrypts every connection. See tlsutil for configs
+	// that pick up rotated certificates.
+	TLS *tls.Config
+}
+
+type Client struct {
+	config Config
+	pools  map[string]*pool
+	closed chan struct{}
+}
+
+func New(config Config) (*Client, error) {
+	if len(config.Ports) < 2 {
+		return nil, fmt.Errorf("need a primary and a secondary port, got %v", config.Ports)
+	}
+	if config.ClientID == "" {
+		config.ClientID = RandomID(5)
+		if config.User != "" {
+			config.ClientID = config.User
+		}
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 4
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 2 * time.Second
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = 15 * time.Second
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 100 * time.Millisecond
+	}
+
+	c := &Client{
+		config: config,
+		pools:  make(map[string]*pool),
+		closed: make(chan struct{}),
+	}
+	for _, port := range config.Ports {
+		c.pools[port] = newPool(port, config.ClientID, config.PoolSize, config.DialTimeout, c.creds())
+	}
+	return c, nil
+}
+
+func (c *Client) creds() credentials {
+	return credentials{user: c.config.User, secret: c.config.Secret, tls: c.config.TLS}
+}
+
+func (c *Client) ID() string {
+	return c.config.ClientID
+}
+
+// Owner returns the port of the server that stores key: odd keys live on the
+// primary and even keys on the secondary.
+func Owner(ports []string, key int) string {
+	if key%2 == 0 {
+		return ports[1]
+	}
+	return ports[0]
+}
+
+// Insert is at-least-once: a retried insert may be applied twice, which is
+// harmless because inserts overwrite.
+// It returns the version the write committed at.
+func (c *Client) Insert(ctx context.Context, key int, value int) (database.Timestamp, error) {
+	return c.InsertTTL(ctx, key, value, 0)
+}
+
+// InsertTTL inserts a value that the server drops once ttl has passed.
+func (c *Client) InsertTTL(ctx context.Context, key int, value int, ttl time.Duration) (database.Timestamp, error) {
+	request := wire.Message{Kind: wire.KindRequest, Op: wire.OpInsert, Key: key, Value: value, TTL: ttl}
+	response, err := c.Do(ctx, Owner(c.config.Ports, key), request)
+	if err != nil {
+		return database.Timestamp{}, err
+	}
+	return response.Version, nil
+}
+
+func (c *Client) Lookup(ctx context.Context, key int) (int, error) {
+	return c.LookupAt(ctx, key, database.Timestamp{})
+}
+
+// LookupAt reads key as of version. A zero version reads the latest value.
+func (c *Client) LookupAt(ctx context.Context, key int, version database.Timestamp) (int, error) {
+	request := wire.Message{Kind: wire.KindRequest, Op: wire.OpLookup, Key: key, Version: version}
+	response, err := c.Do(ctx, Owner(c.config.Ports, key), request)
+	if err != nil {
+		return 0, err
+	}
+	return response.Value, nil
+}
+
+// Dictionary asks the primary for a snapshot of both servers taken at the
+// same version.
+func (c *Client) Dictionary(ctx context.Context, version database.Timestamp) (string, error) {
+	request := wire.Message{Kind: wire.KindRequest, Op: wire.OpDictionary, Version: version}
+	response, err := c.Do(ctx, c.config.Ports[0], request)
+	if err != nil {
+		return "", err
+	}
+	return response.Text, nil
+}
+
+// Do sends request to port and waits for the reply, retrying with
+// exponential backoff when the connection fails or the attempt times out.
+func (c *Client) Do(ctx context.Context, port string, request wire.Message) (wire.Message, error) {
+	p, ok := c.pools[port]
+	if !ok {
+		return wire.Message{}, fmt.Errorf("unknown server %s", port)
+	}
+	var lastErr error
+	backoff := c.config.RetryBackoff
+	for attempt := 0; attempt <= c.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+			select {
+			case <-time.After(backoff + jitter):
+			case <-ctx.Done():
+				return wire.Message{}, ctx.Err()
+			case <-c.closed:
+				return wire.Message{}, ErrClosed
+			}
+			backoff *= 2
+		}
+
+		response, err := c.attempt(ctx, p, request)
+		if err == nil {
+			return response, nil
+		}
+		var serverErr *ServerError
+		if errors.Is(err, ErrNotFound) || errors.As(err, &serverErr) || errors.Is(err, ErrClosed) || errors.Is(err, auth.ErrAuthFailed) {
+			return wire.Message{}, err
+		}
+		if ctx.Err() != nil {
+			return wire.Message{}, ctx.Err()
+		}
+		lastErr = err
+	}
+	return wire.Message{}, fmt.Errorf("server %s: giving up after %d attempts: %w", port, c.config.MaxRetries+1, lastErr)
+}
+
+func (c *Client) attempt(ctx context.Context, p *pool, request wire.Message) (wire.Message, error) {
+	conn, err := p.get()
+	if err != nil {
+		return wire.Message{}, err
+	}
+	id, ch, err := conn.send(request)
+	if err != nil {
+		return wire.Message{}, err
+	}
+
+	timer := time.NewTimer(c.config.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return wire.Message{}, fmt.Errorf("connection to %s lost", p.port)
+		}
+		switch response.Status {
+		case wire.StatusOK:
+			return response, nil
+		case wire.StatusNotFound:
+			return wire.Message{}, ErrNotFound
+		}
+		return wire.Message{}, &ServerError{Port: p.port, Message: response.Text}
+	case <-timer.C:
+		conn.cancel(id)
+		return wire.Message{}, fmt.Errorf("request to %s timed out after %s", p.port, c.config.RequestTimeout)
+	case <-ctx.Done():
+		conn.cancel(id)
+		return wire.Message{}, ctx.Err()
+	case <-c.closed:
+		return wire.Message{}, ErrClosed
+	}
+}
+
+func (c *Client) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	for _, p := range c.pools {
+		p.close()
+	}
+	return nil
+}
+
+func RandomID(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz"
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = charset[rand.Intn(len(charset))]
+	}
+	return string(b)
+}
@@ -0,0 +1,191 @@
+package kvclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"pa1/auth"
+	"pa1/tlsutil"
+	"pa1/wire"
+	"sync"
+	"time"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// conn is one multiplexed connection to a server. Requests are pipelined and
+// matched to replies by ID in a single reader goroutine.
+type conn struct {
+	wire     *wire.Conn
+	clientID string
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan wire.Message
+	err     error
+	// notify receives pushed notifications; only watch connections set it.
+	notify func(wire.Message)
+}
+
+// credentials authenticate connections to servers that require it. An
+// empty user skips the handshake, a nil tls dials plain TCP.
+type credentials struct {
+	user   string
+	secret string
+	tls    *tls.Config
+}
+
+func dial(port string, clientID string, timeout time.Duration, creds credentials) (*conn, error) {
+	netConn, err := tlsutil.Dial(port, timeout, creds.tls)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		wire:     wire.NewConn(netConn, wire.Binary),
+		clientID: clientID,
+		pending:  make(map[uint64]chan wire.Message),
+	}
+	if creds.user != "" {
+		if err := auth.ClientHandshake(c.wire, creds.user, creds.secret, clientID); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	// The server routes replies by client ID, so every pooled connection
+	// registers under its own ID.
+	ping := wire.Message{Kind: wire.KindRequest, Op: wire.OpPing, ClientID: clientID}
+	if err := c.wire.Write(ping); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *conn) readLoop() {
+	for {
+		message, err := c.wire.Read()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		if message.Kind == wire.KindNotification {
+			notify := c.notify
+			c.mu.Unlock()
+			if notify != nil {
+				notify(message)
+			}
+			continue
+		}
+		ch, ok := c.pending[message.ID]
+		delete(c.pending, message.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- message
+		}
+	}
+}
+
+// fail marks the connection broken and wakes every waiting request.
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.wire.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *conn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// send writes request and returns a channel that receives the reply, or is
+// closed if the connection breaks first.
+func (c *conn) send(request wire.Message) (uint64, chan wire.Message, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, nil, c.err
+	}
+	c.nextID++
+	request.ID = c.nextID
+	request.ClientID = c.clientID
+	ch := make(chan wire.Message, 1)
+	c.pending[request.ID] = ch
+	c.mu.Unlock()
+
+	if err := c.wire.Write(request); err != nil {
+		c.fail(err)
+		return 0, nil, err
+	}
+	return request.ID, ch, nil
+}
+
+func (c *conn) cancel(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *conn) close() {
+	c.fail(errConnClosed)
+}
+
+// pool holds a fixed number of connection slots to one server. Broken or
+// missing connections are re-dialed on demand.
+type pool struct {
+	port        string
+	clientID    string
+	dialTimeout time.Duration
+	creds       credentials
+
+	mu    sync.Mutex
+	conns []*conn
+	next  int
+}
+
+func newPool(port string, clientID string, size int, dialTimeout time.Duration, creds credentials) *pool {
+	return &pool{
+		port:        port,
+		clientID:    clientID,
+		dialTimeout: dialTimeout,
+		creds:       creds,
+		conns:       make([]*conn, size),
+	}
+}
+
+func (p *pool) get() (*conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slot := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if c := p.conns[slot]; c != nil && !c.broken() {
+		return c, nil
+	}
+	c, err := dial(p.port, fmt.Sprintf("%s-%d", p.clientID, slot), p.dialTimeout, p.creds)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[slot] = c
+	return c, nil
+}
+
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c != nil {
+			c.close()
+		}
+		p.conns[i] = nil
+	}
+}
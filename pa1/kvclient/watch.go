@@ -0,0 +1,220 @@
+package kvclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"pa1/database"
+	"pa1/wire"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errWatchCancelled = errors.New("watch cancelled by server")
+
+// Event is one committed insert to a watched key.
+type Event struct {
+	Key     int
+	Value   int
+	Version database.Timestamp
+}
+
+// Watch streams changes to a key or key prefix. Each watch has its own
+// connection to the primary, which relays changes to keys the secondary
+// owns. If the connection drops the watch re-dials and resumes where it left
+// off; changes already delivered are not delivered again.
+type Watch struct {
+	client   *Client
+	clientID string
+	pattern  string
+	events   chan Event
+	done     chan struct{}
+	stop     sync.Once
+
+	mu   sync.Mutex
+	conn *conn
+	// Each server's notifications arrive in its own commit order, so the
+	// newest version seen from each is where a resumed watch picks up.
+	since     database.Timestamp
+	lastBy    map[string]database.Timestamp
+	lastByKey map[int]database.Timestamp
+}
+
+var watchCount atomic.Int64
+
+// WatchKey watches a single key, replaying changes after since first when
+// since is not zero.
+func (c *Client) WatchKey(ctx context.Context, key int, since database.Timestamp) (*Watch, error) {
+	return c.watch(ctx, fmt.Sprint(key), since)
+}
+
+// WatchPrefix watches every key whose decimal form starts with prefix.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, since database.Timestamp) (*Watch, error) {
+	return c.watch(ctx, prefix+"*", since)
+}
+
+func (c *Client) watch(ctx context.Context, pattern string, since database.Timestamp) (*Watch, error) {
+	w := &Watch{
+		client:    c,
+		clientID:  fmt.Sprintf("%s-w%d", c.config.ClientID, watchCount.Add(1)),
+		pattern:   pattern,
+		events:    make(chan Event, 64),
+		done:      make(chan struct{}),
+		since:     since,
+		lastBy:    make(map[string]database.Timestamp),
+		lastByKey: make(map[int]database.Timestamp),
+	}
+	if err := w.subscribe(ctx); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Watch) Events() <-chan Event {
+	return w.events
+}
+
+func (w *Watch) Pattern() string {
+	return w.pattern
+}
+
+func (w *Watch) Close() {
+	w.stop.Do(func() {
+		close(w.done)
+		w.mu.Lock()
+		if w.conn != nil {
+			w.conn.close()
+		}
+		w.mu.Unlock()
+	})
+}
+
+// subscribe dials the primary and registers the watch, resuming after the
+// oldest of the newest versions seen from each server.
+func (w *Watch) subscribe(ctx context.Context) error {
+	port := w.client.config.Ports[0]
+	c, err := dial(port, w.clientID, w.client.config.DialTimeout, w.client.creds())
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.notify = w.deliver
+	c.mu.Unlock()
+
+	w.mu.Lock()
+	select {
+	case <-w.done:
+		w.mu.Unlock()
+		c.close()
+		return ErrClosed
+	default:
+	}
+	w.conn = c
+	request := wire.Message{Kind: wire.KindRequest, Op: wire.OpWatch, Text: w.pattern, Version: w.resumePointLocked()}
+	w.mu.Unlock()
+
+	id, ch, err := c.send(request)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(w.client.config.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return fmt.Errorf("connection to %s lost", port)
+		}
+		if response.Status != wire.StatusOK {
+			c.close()
+			return &ServerError{Port: port, Message: response.Text}
+		}
+		return nil
+	case <-timer.C:
+		c.cancel(id)
+		c.close()
+		return fmt.Errorf("watch on %s timed out after %s", port, w.client.config.RequestTimeout)
+	case <-ctx.Done():
+		c.close()
+		return ctx.Err()
+	}
+}
+
+func (w *Watch) resumePointLocked() database.Timestamp {
+	since := w.since
+	if len(w.lastBy) < len(w.client.config.Ports) {
+		// A server we have heard nothing from yet must replay from the
+		// start of the watch.
+		return since
+	}
+	first := true
+	for _, last := range w.lastBy {
+		if first || last.Before(since) {
+			since = last
+			first = false
+		}
+	}
+	return since
+}
+
+func (w *Watch) deliver(message wire.Message) {
+	if message.Status == wire.StatusError {
+		// The server fell too far behind and dropped us; reconnecting
+		// resumes without a gap.
+		w.mu.Lock()
+		c := w.conn
+		w.mu.Unlock()
+		c.fail(errWatchCancelled)
+		return
+	}
+	w.mu.Lock()
+	if last, ok := w.lastByKey[message.Key]; ok && !last.Before(message.Version) {
+		w.mu.Unlock()
+		return
+	}
+	w.lastByKey[message.Key] = message.Version
+	w.lastBy[Owner(w.client.config.Ports, message.Key)] = message.Version
+	w.mu.Unlock()
+
+	select {
+	case w.events <- Event{Key: message.Key, Value: message.Value, Version: message.Version}:
+	case <-w.done:
+	}
+}
+
+// run waits for the watch connection to break and re-subscribes with
+// backoff until the watch is closed.
+func (w *Watch) run() {
+	defer close(w.events)
+	backoff := w.client.config.RetryBackoff
+	for {
+		w.mu.Lock()
+		c := w.conn
+		w.mu.Unlock()
+		for !c.broken() {
+			select {
+			case <-w.done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		for {
+			jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+			select {
+			case <-w.done:
+				return
+			case <-time.After(backoff + jitter):
+			}
+			if err := w.subscribe(context.Background()); err == nil {
+				backoff = w.client.config.RetryBackoff
+				break
+			}
+			if backoff < 5*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
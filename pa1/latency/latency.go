@@ -0,0 +1,282 @@
+// Package latency simulates network delay. A Model picks a delay per message
+// and the package level Current model is what servers and clients sleep on.
+package latency
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Model interface {
+	Delay(peer string) time.Duration
+	String() string
+}
+
+type Constant struct {
+	D time.Duration
+}
+
+type Uniform struct {
+	Min, Max time.Duration
+}
+
+type Normal struct {
+	Mean, StdDev time.Duration
+}
+
+// Pareto has a heavy tail: most delays sit near Scale, a few are much larger.
+// Max caps the tail when non-zero.
+type Pareto struct {
+	Scale time.Duration
+	Alpha float64
+	Max   time.Duration
+}
+
+// Matrix picks a model by peer, falling back to Default.
+type Matrix struct {
+	ByPeer  map[string]Model
+	Default Model
+}
+
+func (c Constant) Delay(string) time.Duration { return c.D }
+func (c Constant) String() string             { return "constant:" + c.D.String() }
+
+func (u Uniform) Delay(string) time.Duration {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + time.Duration(rand.Int63n(int64(u.Max-u.Min)))
+}
+func (u Uniform) String() string { return fmt.Sprintf("uniform:%s,%s", u.Min, u.Max) }
+
+func (n Normal) Delay(string) time.Duration {
+	d := time.Duration(rand.NormFloat64()*float64(n.StdDev)) + n.Mean
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+func (n Normal) String() string { return fmt.Sprintf("normal:%s,%s", n.Mean, n.StdDev) }
+
+func (p Pareto) Delay(string) time.Duration {
+	u := 1 - rand.Float64() // (0, 1]
+	d := time.Duration(float64(p.Scale) / math.Pow(u, 1/p.Alpha))
+	if p.Max > 0 && d > p.Max {
+		return p.Max
+	}
+	return d
+}
+func (p Pareto) String() string {
+	s := fmt.Sprintf("pareto:%s,%g", p.Scale, p.Alpha)
+	if p.Max > 0 {
+		s += "," + p.Max.String()
+	}
+	return s
+}
+
+func (m Matrix) Delay(peer string) time.Duration {
+	if model, ok := m.ByPeer[peer]; ok {
+		return model.Delay(peer)
+	}
+	if m.Default != nil {
+		return m.Default.Delay(peer)
+	}
+	return 0
+}
+func (m Matrix) String() string {
+	peers := make([]string, 0, len(m.ByPeer))
+	for peer := range m.ByPeer {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	entries := make([]string, 0, len(peers)+1)
+	for _, peer := range peers {
+		entries = append(entries, peer+"="+m.ByPeer[peer].String())
+	}
+	if m.Default != nil {
+		entries = append(entries, "*="+m.Default.String())
+	}
+	return "matrix:" + strings.Join(entries, ";")
+}
+
+// Parse reads a model spec:
+//
+//	3s | 3                         constant (a bare number is seconds)
+//	constant:3s
+//	uniform:1s,5s
+//	normal:3s,500ms
+//	pareto:500ms,1.5[,30s]         scale, alpha, optional cap
+//	matrix:9001=constant:1s;*=uniform:0s,2s
+func Parse(spec string) (Model, error) {
+	spec = strings.TrimSpace(spec)
+	kind, args, hasArgs := strings.Cut(spec, ":")
+	if !hasArgs {
+		d, err := parseDuration(spec)
+		if err != nil {
+			return nil, err
+		}
+		return Constant{D: d}, nil
+	}
+
+	if kind == "matrix" {
+		matrix := Matrix{ByPeer: make(map[string]Model)}
+		for _, entry := range strings.Split(args, ";") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			peer, peerSpec, ok := strings.Cut(entry, "=")
+			if !ok {
+				return nil, fmt.Errorf("matrix entry %q is not peer=model", entry)
+			}
+			model, err := Parse(peerSpec)
+			if err != nil {
+				return nil, err
+			}
+			if _, nested := model.(Matrix); nested {
+				return nil, fmt.Errorf("matrix entries cannot be matrices")
+			}
+			peer = strings.TrimSpace(peer)
+			if peer == "*" {
+				matrix.Default = model
+			} else {
+				matrix.ByPeer[peer] = model
+			}
+		}
+		return matrix, nil
+	}
+
+	parts := strings.Split(args, ",")
+	durations := func(n int) ([]time.Duration, error) {
+		if len(parts) < n {
+			return nil, fmt.Errorf("%s needs %d arguments", kind, n)
+		}
+		result := make([]time.Duration, n)
+		for i := 0; i < n; i++ {
+			d, err := parseDuration(parts[i])
+			if err != nil {
+				return nil, err
+			}
+			result[i] = d
+		}
+		return result, nil
+	}
+
+	switch kind {
+	case "constant":
+		d, err := durations(1)
+		if err != nil {
+			return nil, err
+		}
+		return Constant{D: d[0]}, nil
+	case "uniform":
+		d, err := durations(2)
+		if err != nil {
+			return nil, err
+		}
+		if d[1] < d[0] {
+			return nil, fmt.Errorf("uniform max is below min")
+		}
+		return Uniform{Min: d[0], Max: d[1]}, nil
+	case "normal":
+		d, err := durations(2)
+		if err != nil {
+			return nil, err
+		}
+		return Normal{Mean: d[0], StdDev: d[1]}, nil
+	case "pareto":
+		d, err := durations(1)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("pareto needs a scale and an alpha")
+		}
+		alpha, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || alpha <= 0 {
+			return nil, fmt.Errorf("invalid pareto alpha %q", parts[1])
+		}
+		model := Pareto{Scale: d[0], Alpha: alpha}
+		if len(parts) > 2 {
+			max, err := parseDuration(parts[2])
+			if err != nil {
+				return nil, err
+			}
+			model.Max = max
+		}
+		return model, nil
+	}
+	return nil, fmt.Errorf("unknown delay model %q", kind)
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("negative delay %q", s)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delay %q", s)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative delay %q", s)
+	}
+	return d, nil
+}
+
+var (
+	mutex   sync.RWMutex
+	current Model = Constant{D: 3 * time.Second}
+)
+
+// Logger receives one CSV line per injected delay:
+// unix_ms,peer,delay_ms,label
+var Logger = log.New(io.Discard, "", 0)
+
+func Set(model Model) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	current = model
+}
+
+func Current() Model {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current
+}
+
+// Sleep blocks for a delay drawn from the current model for peer and logs it.
+func Sleep(peer string, label string) time.Duration {
+	d := Current().Delay(peer)
+	Logger.Printf("%d,%s,%.3f,%s", time.Now().UnixMilli(), peer, float64(d)/float64(time.Millisecond), label)
+	time.Sleep(d)
+	return d
+}
+
+// LogTo sends delay logs to path, "-" for stderr, or nowhere when empty.
+func LogTo(path string) error {
+	switch path {
+	case "":
+		Logger.SetOutput(io.Discard)
+	case "-":
+		Logger.SetOutput(os.Stderr)
+	default:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		Logger.SetOutput(file)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Package logging is a leveled wrapper around the standard logger. Program
+// output such as "Cmd:" and "Output:" lines does not go through here.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+	Off
+)
+
+var names = []string{"debug", "info", "warn", "error", "off"}
+
+var current atomic.Int32
+
+func init() {
+	current.Store(int32(Info))
+}
+
+func (l Level) String() string {
+	if l < Debug || l > Off {
+		return "unknown"
+	}
+	return names[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, n := range names {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+func SetLevel(level Level) {
+	current.Store(int32(level))
+}
+
+func CurrentLevel() Level {
+	return Level(current.Load())
+}
+
+func Enabled(level Level) bool {
+	return level >= CurrentLevel() && level < Off
+}
+
+func logf(level Level, format string, args ...any) {
+	if Enabled(level) {
+		log.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, args...))
+	}
+}
+
+func Debugf(format string, args ...any) { logf(Debug, format, args...) }
+func Infof(format string, args ...any)  { logf(Info, format, args...) }
+func Warnf(format string, args ...any)  { logf(Warn, format, args...) }
+func Errorf(format string, args ...any) { logf(Error, format, args...) }
@@ -0,0 +1,462 @@
+// Package peer keeps outbound links between servers alive. Each link dials
+// with exponential backoff, sends heartbeats, re-dials when the peer goes
+// away and queues messages while it is down.
+package peer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"pa1/logging"
+	"pa1/wire"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("peer is down and its queue is full")
+var ErrUnavailable = errors.New("peer unavailable")
+
+type Config struct {
+	// Self is this server's port, sent in the hello ping so the peer can
+	// route replies back over the link.
+	Self              string
+	Protocol          wire.Protocol
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	HeartbeatInterval time.Duration
+	// A link is considered dead after this long without hearing back.
+	HeartbeatTimeout time.Duration
+	MaxQueue         int
+	// OnMessage receives replies read from a link that no Request is
+	// waiting for, except heartbeats, and any notifications.
+	OnMessage func(port string, message wire.Message)
+	// Dial opens the connection for a link. It defaults to plain TCP.
+	Dial func(port string, timeout time.Duration) (net.Conn, error)
+	// Handshake, when set, runs on every new connection before the hello
+	// ping, to authenticate the link.
+	Handshake func(conn *wire.Conn) error
+	// OnConnect runs after every successful dial, once queued messages have
+	// been flushed, so state the peer lost can be sent again.
+	OnConnect func(port string)
+}
+
+type Status struct {
+	Port       string    `json:"port"`
+	Connected  bool      `json:"connected"`
+	Queued     int       `json:"queued"`
+	Reconnects int       `json:"reconnects"`
+	LastSeen   time.Time `json:"last_seen"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+type Link struct {
+	port   string
+	config *Config
+
+	mu         sync.Mutex
+	conn       *wire.Conn
+	queue      []wire.Message
+	reconnects int
+	lastSeen   time.Time
+	lastError  string
+	down       chan struct{}
+	closed     bool
+
+	// Requests waiting for a reply. Binary links match replies by ID; text
+	// links have no IDs but the peer answers in order, so replies are
+	// matched first in, first out. A nil channel is a slot whose reply
+	// nobody waits for.
+	nextID   uint64
+	inflight map[uint64]chan wire.Message
+	fifo     []chan wire.Message
+}
+
+type Manager struct {
+	config Config
+
+	mu    sync.RWMutex
+	links map[string]*Link
+}
+
+func NewManager(config Config) *Manager {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 5 * time.Second
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = time.Second
+	}
+	if config.HeartbeatTimeout <= 0 {
+		config.HeartbeatTimeout = 3 * config.HeartbeatInterval
+	}
+	if config.MaxQueue <= 0 {
+		config.MaxQueue = 1024
+	}
+	if config.Dial == nil {
+		config.Dial = func(port string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", ":"+port, timeout)
+		}
+	}
+	return &Manager{config: config, links: make(map[string]*Link)}
+}
+
+// Add starts maintaining a link to port. Adding the same port twice is a
+// no-op.
+func (m *Manager) Add(port string) *Link {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if link, ok := m.links[port]; ok {
+		return link
+	}
+	link := &Link{port: port, config: &m.config, inflight: make(map[uint64]chan wire.Message)}
+	m.links[port] = link
+	go link.run()
+	return link
+}
+
+func (m *Manager) Get(port string) (*Link, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	link, ok := m.links[port]
+	return link, ok
+}
+
+// Send writes message to port now if the link is up, otherwise queues it
+// for delivery after the next successful dial.
+func (m *Manager) Send(port string, message wire.Message) error {
+	link, ok := m.Get(port)
+	if !ok {
+		link = m.Add(port)
+	}
+	return link.Send(message)
+}
+
+// Request sends message to port and waits for the matching reply. Unlike
+// Send it never queues: if the link is down the request fails at once.
+func (m *Manager) Request(ctx context.Context, port string, message wire.Message) (wire.Message, error) {
+	link, ok := m.Get(port)
+	if !ok {
+		return wire.Message{}, ErrUnavailable
+	}
+	return link.Request(ctx, message)
+}
+
+func (m *Manager) Statuses() []Status {
+	m.mu.RLock()
+	links := make([]*Link, 0, len(m.links))
+	for _, link := range m.links {
+		links = append(links, link)
+	}
+	m.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(links))
+	for _, link := range links {
+		statuses = append(statuses, link.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Port < statuses[j].Port })
+	return statuses
+}
+
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, link := range m.links {
+		link.close()
+	}
+}
+
+func (l *Link) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Status{
+		Port:       l.port,
+		Connected:  l.conn != nil,
+		Queued:     len(l.queue),
+		Reconnects: l.reconnects,
+		LastSeen:   l.lastSeen,
+		LastError:  l.lastError,
+	}
+}
+
+func (l *Link) Connected() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn != nil
+}
+
+func (l *Link) Send(message wire.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		err := l.writeLocked(l.conn, message, nil)
+		if err == nil {
+			return nil
+		}
+		l.dropLocked(err)
+	}
+	if len(l.queue) >= l.config.MaxQueue {
+		return ErrQueueFull
+	}
+	l.queue = append(l.queue, message)
+	return nil
+}
+
+func (l *Link) Request(ctx context.Context, message wire.Message) (wire.Message, error) {
+	reply := make(chan wire.Message, 1)
+	l.mu.Lock()
+	if l.conn == nil {
+		l.mu.Unlock()
+		return wire.Message{}, ErrUnavailable
+	}
+	if err := l.writeLocked(l.conn, message, reply); err != nil {
+		l.dropLocked(err)
+		l.mu.Unlock()
+		return wire.Message{}, ErrUnavailable
+	}
+	id := l.nextID
+	l.mu.Unlock()
+
+	select {
+	case response, ok := <-reply:
+		if !ok {
+			return wire.Message{}, ErrUnavailable
+		}
+		return response, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		delete(l.inflight, id)
+		l.mu.Unlock()
+		return wire.Message{}, ctx.Err()
+	}
+}
+
+// writeLocked gives a request a link-local ID and a reply slot, then writes
+// it. Must be called with l.mu held.
+func (l *Link) writeLocked(conn *wire.Conn, message wire.Message, reply chan wire.Message) error {
+	if message.Kind == wire.KindRequest && message.Op != wire.OpPing && message.Op != wire.OpHeartbeat {
+		l.nextID++
+		message.ID = l.nextID
+		if conn.Protocol == wire.Text {
+			l.fifo = append(l.fifo, reply)
+		} else if reply != nil {
+			l.inflight[message.ID] = reply
+		}
+	}
+	return conn.Write(message)
+}
+
+// deliver hands a reply to the request waiting for it and reports whether
+// there was one.
+func (l *Link) deliver(conn *wire.Conn, message wire.Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var reply chan wire.Message
+	if conn.Protocol == wire.Text {
+		if len(l.fifo) == 0 {
+			return false
+		}
+		reply = l.fifo[0]
+		l.fifo = l.fifo[1:]
+		if reply == nil {
+			// The reply to a Send; text replies carry nothing to tell
+			// them apart, so they are consumed here.
+			return true
+		}
+	} else {
+		reply = l.inflight[message.ID]
+		delete(l.inflight, message.ID)
+	}
+	if reply == nil {
+		return false
+	}
+	reply <- message
+	return true
+}
+
+// run dials until the link is closed. Each connection lives until a read
+// fails or heartbeats stop coming back, then the loop dials again.
+func (l *Link) run() {
+	backoff := l.config.MinBackoff
+	for {
+		if l.isClosed() {
+			return
+		}
+		netConn, err := l.config.Dial(l.port, l.config.MaxBackoff)
+		if err != nil {
+			l.mu.Lock()
+			l.lastError = err.Error()
+			l.mu.Unlock()
+			jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+			time.Sleep(backoff + jitter)
+			backoff *= 2
+			if backoff > l.config.MaxBackoff {
+				backoff = l.config.MaxBackoff
+			}
+			continue
+		}
+		backoff = l.config.MinBackoff
+
+		conn := wire.NewConn(netConn, l.config.Protocol)
+		if err := l.connected(conn); err != nil {
+			logging.Warnf("Error initializing link to %s: %v", l.port, err)
+			conn.Close()
+			continue
+		}
+		if l.config.OnConnect != nil {
+			l.config.OnConnect(l.port)
+		}
+		l.serve(conn)
+	}
+}
+
+// connected sends the hello ping and flushes queued messages before the link
+// is made visible to Send, so queued messages keep their order.
+func (l *Link) connected(conn *wire.Conn) error {
+	if l.config.Handshake != nil {
+		if err := l.config.Handshake(conn); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hello := wire.Message{Kind: wire.KindRequest, Op: wire.OpPing, ClientID: l.config.Self}
+	if err := conn.Write(hello); err != nil {
+		return err
+	}
+	for len(l.queue) > 0 {
+		if err := l.writeLocked(conn, l.queue[0], nil); err != nil {
+			l.fifo = nil
+			return err
+		}
+		l.queue = l.queue[1:]
+	}
+	if l.lastSeen.IsZero() {
+		logging.Infof("Connected to peer %s", l.port)
+	} else {
+		l.reconnects++
+		logging.Infof("Reconnected to peer %s", l.port)
+	}
+	l.conn = conn
+	l.lastSeen = time.Now()
+	l.lastError = ""
+	l.down = make(chan struct{})
+	return nil
+}
+
+func (l *Link) serve(conn *wire.Conn) {
+	l.mu.Lock()
+	down := l.down
+	l.mu.Unlock()
+
+	go l.heartbeat(conn, down)
+	for {
+		var message wire.Message
+		var err error
+		if conn.Protocol == wire.Text {
+			var line string
+			line, err = conn.ReadLine()
+			message = wire.Message{Kind: wire.KindResponse, Text: line}
+			if line == "heartbeat" {
+				message.Op = wire.OpHeartbeat
+			} else if parsed := wire.ParseText(line); parsed.Kind == wire.KindNotification {
+				message = parsed
+			}
+		} else {
+			message, err = conn.Read()
+		}
+		if err != nil {
+			l.drop(conn, err)
+			return
+		}
+
+		l.mu.Lock()
+		l.lastSeen = time.Now()
+		l.mu.Unlock()
+		if message.Op == wire.OpHeartbeat {
+			continue
+		}
+		if message.Kind != wire.KindNotification && l.deliver(conn, message) {
+			continue
+		}
+		if l.config.OnMessage != nil {
+			l.config.OnMessage(l.port, message)
+		}
+	}
+}
+
+func (l *Link) heartbeat(conn *wire.Conn, down chan struct{}) {
+	ticker := time.NewTicker(l.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-down:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		silent := time.Since(l.lastSeen)
+		l.mu.Unlock()
+		if silent > l.config.HeartbeatTimeout {
+			l.drop(conn, errors.New("heartbeat timeout"))
+			return
+		}
+		ping := wire.Message{Kind: wire.KindRequest, Op: wire.OpHeartbeat, ClientID: l.config.Self}
+		if err := conn.Write(ping); err != nil {
+			l.drop(conn, err)
+			return
+		}
+	}
+}
+
+// drop tears down conn if it is still the live connection.
+func (l *Link) drop(conn *wire.Conn, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == conn {
+		l.dropLocked(err)
+	} else {
+		conn.Close()
+	}
+}
+
+func (l *Link) dropLocked(err error) {
+	if l.conn == nil {
+		return
+	}
+	if !l.closed {
+		logging.Warnf("Lost connection to peer %s: %v", l.port, err)
+	}
+	l.lastError = err.Error()
+	l.conn.Close()
+	l.conn = nil
+	close(l.down)
+
+	// Replies to anything in flight are lost with the connection.
+	for id, reply := range l.inflight {
+		close(reply)
+		delete(l.inflight, id)
+	}
+	for _, reply := range l.fifo {
+		if reply != nil {
+			close(reply)
+		}
+	}
+	l.fifo = nil
+}
+
+func (l *Link) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *Link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.dropLocked(errors.New("closed"))
+}
@@ -1,12 +1,33 @@
+//go:build ignore
+
+// Run with: go run server.go
+
 package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"pa1/auth"
+	"pa1/database"
+	"pa1/latency"
+	"pa1/logging"
+	"pa1/peer"
+	"pa1/stats"
+	"pa1/tlsutil"
+	"pa1/watch"
+	"pa1/wire"
+	"pa1/worker"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,17 +40,49 @@ import (
 var PortsList []string
 var LeaderPort string
 var IsLeader bool
-var NetworkDelay = 3
 
-// Database variables
-var DB map[int]int
-var Mutex sync.RWMutex
+var Protocol = wire.Binary
+
+var connectionMap = make(map[string]*wire.Conn)
+var connectionMutex sync.RWMutex
 
-var connectionMap = make(map[string]net.Conn)
+var Workers *worker.Pool
+var Peers *peer.Manager
+var ForwardTimeout = 10 * time.Second
+var Watches = watch.NewHub()
+
+// Auth is nil when the server runs without -auth and accepts anyone.
+var Auth *auth.Authenticator
+
+// TLS is nil when connections are plain TCP.
+var TLS *tlsutil.Reloader
 
 func main() {
 	ports := flag.String("ports", "", "Comma-separated list of ports")
 	leaderPort := flag.String("leader", "", "Leader port")
+	dataDir := flag.String("data", "data", "Directory for the write-ahead log and snapshots, empty to run in memory")
+	syncWrites := flag.Bool("sync", true, "fsync the write-ahead log before acknowledging inserts")
+	snapshotInterval := flag.Duration("snapshot-interval", 30*time.Second, "Interval between database snapshots")
+	protocol := flag.String("protocol", "binary", "Wire protocol: binary or text")
+	delay := flag.String("delay", "constant:3s", "Simulated network delay model, see latency.Parse")
+	delayLog := flag.String("delay-log", "", "File to log injected delays to as CSV, - for stderr")
+	workers := flag.Int("workers", 64, "Number of requests served concurrently")
+	forwardTimeout := flag.Duration("forward-timeout", 10*time.Second, "How long the leader waits for the secondary to answer a forwarded request")
+	logLevel := flag.String("loglevel", "info", "Log level: debug, info, warn, error or off")
+	debugAddr := flag.String("debug-addr", "", "Address for the HTTP /debug endpoint, e.g. localhost:8000")
+	maxKeys := flag.Int("max-keys", 0, "Evict keys beyond this many, 0 for no limit")
+	maxBytes := flag.Int64("max-bytes", 0, "Evict keys once estimated memory use exceeds this many bytes, 0 for no limit")
+	eviction := flag.String("eviction", "lru", "Eviction policy: lru or lfu")
+	maxVersions := flag.Int("max-versions", 100, "Versions kept per key for time-travel reads, 0 for no limit")
+	versionRetention := flag.Duration("version-retention", 0, "Drop versions superseded this long before a key's latest, 0 to keep them")
+	authFile := flag.String("auth", "", "JSON file with the cluster secret and client credentials, empty to disable authentication")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve TLS with, also presented on links to other servers")
+	tlsKey := flag.String("tls-key", "", "PEM key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "PEM CA that signs client and server certificates")
+	tlsServerName := flag.String("tls-server-name", "localhost", "Name the other servers' certificates must be valid for")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Reject clients without a certificate signed by -tls-ca")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", 10*time.Second, "How often to check the TLS files for changes")
+	expiryInterval := flag.Duration("expiry-interval", time.Second, "Interval between sweeps for expired keys")
 	flag.Parse()
 
 	if *ports == "" || *leaderPort == "" {
@@ -37,7 +90,65 @@ func main() {
 	}
 
 	initializeConfig(*ports, *leaderPort)
-	initializeDatabase()
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetLevel(level)
+	selected, err := wire.ParseProtocol(*protocol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Protocol = selected
+	model, err := latency.Parse(*delay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	latency.Set(model)
+	if err := latency.LogTo(*delayLog); err != nil {
+		log.Fatal(err)
+	}
+	database.Initialize()
+	if *dataDir != "" {
+		if err := database.Open(filepath.Join(*dataDir, PortsList[0]), *syncWrites); err != nil {
+			log.Fatal("Error recovering database: " + err.Error())
+		}
+		database.StartSnapshots(*snapshotInterval)
+	}
+	policy, err := database.ParseEvictionPolicy(*eviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *authFile != "" {
+		Auth, err = auth.Load(*authFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *tlsCert != "" {
+		TLS, err = tlsutil.NewReloader(tlsutil.Config{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			CAFile:            *tlsCA,
+			ServerName:        *tlsServerName,
+			RequireClientCert: *tlsRequireClientCert,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		TLS.Watch(*tlsReloadInterval)
+	}
+	database.SetLimits(database.Limits{
+		MaxKeys:          *maxKeys,
+		MaxBytes:         *maxBytes,
+		Policy:           policy,
+		MaxVersions:      *maxVersions,
+		VersionRetention: *versionRetention,
+	})
+	database.StartExpiry(*expiryInterval)
+	database.Committed = Watches.Publish
+	Workers = worker.NewPool(*workers, *workers)
+	ForwardTimeout = *forwardTimeout
 	go handleCLIInput()
 
 	addr, err := net.ResolveTCPAddr("tcp", ":"+PortsList[0])
@@ -66,12 +177,20 @@ func main() {
 	// 	println("State: Follower")
 	// }
 
-	go initalizeFollowerConnections()
+	var connections net.Listener = listener
+	if TLS != nil {
+		connections = tls.NewListener(listener, TLS.ServerConfig())
+	}
+
+	initalizeFollowerConnections()
+	if *debugAddr != "" {
+		startDebugServer(*debugAddr)
+	}
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := connections.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			logging.Errorf("Error accepting connection: %v", err)
 			return
 		}
 		go handleConnection(conn)
@@ -97,15 +216,40 @@ func initializeConfig(ports string, leaderPort string) {
 func handleCLIInput() {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
-		command := scanner.Text()
-		switch command {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
 		case "dictionary":
-			handleDump()
+			at, err := wire.ParseVersionArg(fields[1:])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if _, err := handleDump(at); err != nil {
+				fmt.Println(err)
+			}
+		case "setdelay":
+			handleSetDelay(fields[1:])
+		case "stats":
+			handleStats()
+		case "clients":
+			dumpConnectionMap()
+		case "peers":
+			handlePeers()
+		case "snapshot":
+			handleSnapshot()
+		case "loglevel":
+			handleLogLevel(fields[1:])
+		case "reloadcerts":
+			handleReloadCerts()
 		case "exit":
 			fmt.Println("Exiting...")
+			database.Close()
 			os.Exit(0)
 		default:
-			fmt.Println("Invalid command. Available commands: dictionary, exit")
+			fmt.Println("Invalid command. Available commands: dictionary [@version], stats, clients, peers, setdelay [model], snapshot, loglevel [level], reloadcerts, exit")
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -113,178 +257,646 @@ func handleCLIInput() {
 	}
 }
 
+func handleSetDelay(args []string) {
+	if len(args) == 0 {
+		fmt.Printf("Delay model: %s\n", latency.Current())
+		return
+	}
+	model, err := latency.Parse(strings.Join(args, " "))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	latency.Set(model)
+	fmt.Printf("Delay model set to %s\n", model)
+}
+
 func initalizeFollowerConnections() {
-	time.Sleep(3 * time.Second)
-	for _, port := range PortsList {
-		if port == PortsList[0] {
-			continue
+	config := peer.Config{
+		Self:      PortsList[0],
+		Protocol:  Protocol,
+		OnMessage: handlePeerMessage,
+		OnConnect: handlePeerConnect,
+	}
+	if TLS != nil {
+		config.Dial = func(port string, timeout time.Duration) (net.Conn, error) {
+			return tlsutil.Dial(port, timeout, TLS.ClientConfig())
 		}
-		conn, err := net.Dial("tcp", ":"+port)
-		if err != nil {
-			log.Fatal(err)
+	}
+	if Auth != nil {
+		config.Handshake = func(conn *wire.Conn) error {
+			return auth.ClientHandshake(conn, PortsList[0], Auth.ClusterSecret(), PortsList[0])
 		}
-		connectionMap[port] = conn
+	}
+	Peers = peer.NewManager(config)
+	for _, port := range PortsList[1:] {
+		Peers.Add(port)
+	}
+}
 
-		writer := bufio.NewWriter(conn)
-		writer.WriteString(port + " ping\n")
-		writer.Flush()
+// handlePeerMessage receives notifications for forwarded watches and
+// replies on our links to other servers that no relayed request is waiting
+// for anymore, usually because it timed out.
+func handlePeerMessage(port string, message wire.Message) {
+	if message.Kind == wire.KindNotification {
+		if message.Status == wire.StatusError {
+			logging.Warnf("Peer %s cancelled forwarded watches: %s", port, message.Text)
+			return
+		}
+		if !Watches.Relay(message) {
+			// Nobody here wants it anymore, so stop the peer sending it.
+			Peers.Send(port, wire.Message{Kind: wire.KindRequest, Op: wire.OpUnwatch, ClientID: message.ClientID, Text: message.Text})
+		}
+		return
 	}
+	if message.Op == wire.OpWatch || message.Op == wire.OpUnwatch {
+		return
+	}
+	logging.Warnf("Dropping late reply from %s: %s", port, message.Text)
 }
 
-func handleConnection(conn net.Conn) {
-	reader := bufio.NewReader(conn)
+// handlePeerConnect re-sends forwarded watches after a (re)connect, since
+// the peer forgets them when the link drops.
+func handlePeerConnect(port string) {
+	for _, request := range Watches.Forwarded() {
+		if err := Peers.Send(port, request); err != nil {
+			logging.Warnf("Error re-sending %q to %s: %v", request.Command(), port, err)
+		}
+	}
+}
+
+func handleConnection(netConn net.Conn) {
+	conn := wire.NewConn(netConn, Protocol)
+	sequencer := worker.NewSequencer()
+	var watcher *watch.Watcher
+	defer func() {
+		// Let in-flight requests finish writing before the connection goes.
+		sequencer.Wait()
+		if watcher != nil {
+			for _, unwatch := range watcher.Close() {
+				Peers.Send(PortsList[1], unwatch)
+			}
+		}
+		releaseConnection(conn)
+		conn.Close()
+	}()
+
+	// With auth enabled every connection starts with a challenge, and
+	// nothing but the answer is accepted until it checks out.
+	var identity *auth.Identity
+	nonce := ""
+	if Auth != nil {
+		nonce = auth.NewChallenge()
+		conn.Write(wire.Message{Kind: wire.KindResponse, Op: wire.OpAuth, Text: "challenge " + nonce})
+	}
+
+	// Name of the peer on the other end for the delay model: a client ID,
+	// or the other server's port for links between servers.
+	peerName := ""
 	for {
-		message, err := reader.ReadString('\n')
+		message, err := conn.Read()
 		if err != nil {
-			log.Printf("Error reading from connection: %v", err)
-			continue
+			if err != io.EOF {
+				logging.Warnf("Error reading from connection %s: %v", conn.RemoteAddr(), err)
+			}
+			return
 		}
 
-		message = strings.TrimSpace(message)
-		clientID := strings.Split(message, " ")[0]
-
-		if strings.Split(message, " ")[1] == "ping" {
-			connectionMap[clientID] = conn
-		} else if strings.Split(message, " ")[0] == "secondary" {
-			fmt.Printf("%s\n", message)
+		if message.Kind != wire.KindRequest {
 			continue
-		} else {
-			trimmedMessage := strings.TrimPrefix(message, clientID+" ")
-			fmt.Printf("Cmd: %s\n", trimmedMessage)
-			response := handleMessage(message)
-			if response != "" {
-				sendResponse(clientID, response)
+		}
+		if Auth != nil {
+			if message.Op == wire.OpAuth && identity == nil {
+				id, err := Auth.Verify(nonce, message)
+				if err != nil {
+					name, _, _ := strings.Cut(message.Text, " ")
+					logging.Warnf("Rejected %s from %s as %q: %v", message.ClientID, conn.RemoteAddr(), name, err)
+					conn.Write(wire.Reply(message, wire.StatusError, err.Error()))
+					return
+				}
+				identity = &id
+				logging.Infof("Authenticated %s as %s (%s)", conn.RemoteAddr(), id.Name, id.Role)
+				conn.Write(wire.Reply(message, wire.StatusOK, "Authenticated"))
+				continue
+			}
+			if identity == nil {
+				conn.Write(wire.Reply(message, wire.StatusError, auth.ErrNotAuthenticated.Error()))
+				return
+			}
+			if err := Auth.Authorize(*identity, message); err != nil {
+				logging.Warnf("Denied %q for %s on a connection authenticated as %s: %v", message.Command(), message.ClientID, identity.Name, err)
+				if message.Op == wire.OpPing || message.Op == wire.OpHeartbeat {
+					continue
+				}
+				response := wire.Reply(message, wire.StatusError, err.Error())
+				seq := sequencer.Reserve()
+				sequencer.Complete(seq, func() {
+					conn.Write(response)
+				})
+				continue
+			}
+		}
+		if message.Op == wire.OpPing {
+			if TLS != nil && isServerPort(message.ClientID) && !tlsutil.VerifiedServer(conn.Conn) {
+				// Links between servers are mutually authenticated.
+				logging.Warnf("Rejected %s claiming to be server %s without a server certificate", conn.RemoteAddr(), message.ClientID)
+				return
 			}
+			registerConnection(message.ClientID, conn)
+			peerName = message.ClientID
+			continue
+		}
+		if message.Op == wire.OpHeartbeat {
+			// Answered right away, outside the simulated delay, so slow
+			// requests never make a live peer look dead.
+			conn.Write(wire.Reply(message, wire.StatusOK, "heartbeat"))
+			continue
+		}
+
+		fmt.Printf("Cmd: %s\n", message.Command())
+		received := time.Now()
+		seq := sequencer.Reserve()
+		if message.Op == wire.OpWatch || message.Op == wire.OpUnwatch {
+			// Watches belong to this connection, so they are registered
+			// here rather than on a worker.
+			if watcher == nil {
+				fromServer := isServerPort(peerName)
+				watcher = Watches.NewWatcher(func(notification wire.Message) error {
+					err := conn.Write(notification)
+					if notification.Status == wire.StatusError && fromServer {
+						// Dropping the link makes the leader re-subscribe
+						// from the last version it relayed.
+						conn.Close()
+					}
+					return err
+				})
+			}
+			response := handleWatch(watcher, message)
+			stats.Record(message.Op.String(), time.Since(received), response.Status == wire.StatusError)
+			sequencer.Complete(seq, func() {
+				conn.Write(response)
+			})
+			continue
+		}
+		requestPeer := peerName
+		job := func() {
+			response := serveRequest(message, requestPeer)
+			stats.Record(message.Op.String(), time.Since(received), response.Status == wire.StatusError)
+			logging.Debugf("Served %q for %s in %s", message.Command(), message.ClientID, time.Since(received))
+			// Replies always go back on the connection the request came in
+			// on, which for forwarded requests is the leader's link.
+			sequencer.Complete(seq, func() {
+				conn.Write(response)
+			})
+		}
+		if !isServerPort(peerName) {
+			// Blocking pushes back on a client sending faster than we serve.
+			Workers.Submit(job)
+			continue
+		}
+		// A peer link must keep being read, or the heartbeats behind this
+		// request go unanswered and a busy server looks dead. The leader
+		// passes the error on to the client.
+		if !Workers.TrySubmit(job) {
+			logging.Warnf("Workers busy, refusing %q from %s", message.Command(), peerName)
+			stats.Record(message.Op.String(), time.Since(received), true)
+			response := wire.Reply(message, wire.StatusError, "server busy")
+			sequencer.Complete(seq, func() {
+				conn.Write(response)
+			})
 		}
 	}
 }
 
-func handleMessage(message string) string {
-	time.Sleep(time.Duration(NetworkDelay) * time.Second)
+// serveRequest runs on a worker. Replies are handed back to the connection's
+// sequencer so they leave in the order the requests arrived.
+func serveRequest(message wire.Message, peerName string) wire.Message {
+	if peerName == "" {
+		peerName = message.ClientID
+	}
+	forwarded := isServerPort(peerName)
+	latency.Sleep(peerName, fmt.Sprintf("%s key=%d forwarded=%t", message.Op, message.Key, forwarded))
 
-	args := strings.Split(message, " ")
-	clientID := args[0]
-	command := args[1]
+	return handleMessage(message)
+}
 
-	if command == "insert" {
-		if len(args) != 4 {
-			return "missing parameters"
-		}
-		key, err := strconv.Atoi(args[2])
+func handleMessage(message wire.Message) wire.Message {
+	switch message.Op {
+	case wire.OpInsert:
+		return handleInsert(message)
+	case wire.OpLookup:
+		return handleLookup(message)
+	case wire.OpDictionary:
+		dump, err := handleDump(message.Version)
 		if err != nil {
-			return "invalid key"
+			return wire.Reply(message, wire.StatusError, err.Error())
 		}
-		value, err := strconv.Atoi(args[3])
-		if err != nil {
-			return "invalid value"
+		return wire.Reply(message, wire.StatusOK, dump)
+	}
+	if message.Text == "" {
+		message.Text = "invalid command"
+	}
+	return wire.Reply(message, wire.StatusError, message.Text)
+}
+
+// handleWatch registers or removes a watch on this server. On the leader,
+// watches that cover keys the secondary owns are also forwarded there and
+// its notifications relayed back.
+func handleWatch(watcher *watch.Watcher, message wire.Message) wire.Message {
+	pattern := watch.Pattern(message.Text)
+	forward := IsLeader && len(PortsList) > 1
+	if key, ok := pattern.Key(); ok && key%2 != 0 {
+		forward = false
+	}
+
+	if message.Op == wire.OpUnwatch {
+		found, forwarded := watcher.Unwatch(message)
+		if !found {
+			fmt.Printf("Output: Not watching %s\n", message.Text)
+			return wire.Reply(message, wire.StatusNotFound, "NOT WATCHING")
 		}
-		return handleInsert(clientID, key, value)
-	} else if command == "lookup" {
-		if len(args) != 3 {
-			return "error"
+		if forwarded {
+			Peers.Send(PortsList[1], message)
 		}
-		key, err := strconv.Atoi(args[2])
-		if err != nil {
-			return "invalid key"
+		fmt.Printf("Output: Stopped watching %s\n", message.Text)
+		return wire.Reply(message, wire.StatusOK, "Success")
+	}
+
+	if err := watcher.Watch(message, forward); err != nil {
+		fmt.Printf("Output: Error watching %s: %v\n", message.Text, err)
+		return wire.Reply(message, wire.StatusError, "error")
+	}
+	if forward {
+		// Queued while the link is down; handlePeerConnect re-sends it
+		// either way and duplicates are dropped by version.
+		if err := Peers.Send(PortsList[1], message); err != nil {
+			logging.Warnf("Error forwarding %q to %s: %v", message.Command(), PortsList[1], err)
 		}
-		return handleLookup(clientID, key)
-	} else if command == "dictionary" {
-		return handleDump()
-	} else if command == "ping" {
-		return ""
 	}
-	return "invalid command"
+	fmt.Printf("Output: Watching %s for %s\n", message.Text, message.ClientID)
+	return wire.Reply(message, wire.StatusOK, "Watching")
 }
 
-func handleInsert(clientID string, key int, value int) string {
+// handleInsert replies with the version the write committed at in the binary
+// Version field, so a client can read its own write with lookup @version.
+func handleInsert(message wire.Message) wire.Message {
+	key := message.Key
 	if key%2 == 0 && IsLeader {
-		forwardMessage(fmt.Sprintf("%s insert %d %d", clientID, key, value))
 		println("Output: Forwarding to secondary server")
-		return ""
+		// Stamped with the leader's clock, so the secondary commits after
+		// anything the leader has already served.
+		message.Version = database.HLC.Now()
+		return relayToSecondary(message)
+	}
+	if !message.Version.IsZero() {
+		if err := database.CheckOffset(message.Version); err != nil {
+			fmt.Printf("Output: Rejected insert of key %d @%s: %v\n", key, message.Version, err)
+			return wire.Reply(message, wire.StatusError, err.Error())
+		}
+		database.HLC.Update(message.Version)
+	}
+	ts, err := database.InsertTTL(key, message.Value, message.TTL)
+	if err != nil {
+		fmt.Printf("Output: Error inserting key %d: %v\n", key, err)
+		return wire.Reply(message, wire.StatusError, "error")
 	}
-	Insert(key, value)
 	fmt.Printf("Output: Successfully inserted key %d\n", key)
-	return "Success"
+	response := wire.Reply(message, wire.StatusOK, "Success")
+	response.Version = ts
+	return response
 }
 
-func handleLookup(clientID string, key int) string {
+func handleLookup(message wire.Message) wire.Message {
+	key, at := message.Key, message.Version
 	if key%2 == 0 && IsLeader {
-		forwardMessage(fmt.Sprintf("%s lookup %d", clientID, key))
 		println("Output: Forwarding to secondary server")
-		return ""
+		return relayToSecondary(message)
+	}
+	var value int
+	var ok bool
+	if at.IsZero() {
+		value, ok = database.Lookup(key)
+	} else {
+		// A later write must not land at or below the version we serve, so
+		// wait for the clock to pass it rather than moving the clock.
+		if err := database.HLC.WaitPast(at); err != nil {
+			fmt.Printf("Output: Rejected lookup at %s: %v\n", at, err)
+			return wire.Reply(message, wire.StatusError, err.Error())
+		}
+		value, ok = database.LookupAt(key, at)
 	}
-	value, ok := Lookup(key)
 	if !ok {
 		fmt.Printf("Output: NOT FOUND\n")
-		return "NOT FOUND"
+		return wire.Reply(message, wire.StatusNotFound, "NOT FOUND")
 	}
 	fmt.Printf("Output: %d\n", value)
-	return strconv.Itoa(value)
+	response := wire.Reply(message, wire.StatusOK, strconv.Itoa(value))
+	response.Value = value
+	return response
 }
 
-func handleDump() string {
-	dumpString := Dump()
-	if IsLeader {
-		fmt.Printf("Output: %s, ", dumpString)
-		forwardMessage(fmt.Sprintf("%s dictionary", PortsList[0]))
+// handleDump prints a snapshot of both servers taken at the same version.
+// The leader picks the version and the secondary dumps at it.
+func handleDump(at database.Timestamp) (string, error) {
+	if at.IsZero() && IsLeader {
+		at = database.HLC.Now()
+	}
+	if !at.IsZero() {
+		if err := database.HLC.WaitPast(at); err != nil {
+			fmt.Printf("Output: Rejected dictionary at %s: %v\n", at, err)
+			return "", err
+		}
 	}
-	return dumpString
+	dumpString := Dump(at)
+	if !IsLeader {
+		return dumpString, nil
+	}
+
+	secondary := relayToSecondary(wire.Message{
+		Kind:     wire.KindRequest,
+		Op:       wire.OpDictionary,
+		ClientID: PortsList[0],
+		Version:  at,
+	})
+	if secondary.Status == wire.StatusError {
+		return "", errors.New(secondary.Text)
+	}
+	dumpString = fmt.Sprintf("%s, %s", dumpString, secondary.Text)
+	fmt.Printf("Output: %s\n", dumpString)
+	return dumpString, nil
 }
 
-func forwardMessage(message string) {
-	var conn net.Conn
-	if _, ok := connectionMap[PortsList[1]]; !ok {
-		conn, err := net.Dial("tcp", ":"+PortsList[1])
-		if err != nil {
-			log.Fatal(err)
+// relayToSecondary forwards a request over the leader's link and waits for
+// the secondary's reply, which is then returned to the client as our own.
+func relayToSecondary(message wire.Message) wire.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), ForwardTimeout)
+	defer cancel()
+
+	response, err := Peers.Request(ctx, PortsList[1], message)
+	stats.RecordForward(err != nil)
+	if err != nil {
+		reason := "secondary unreachable"
+		if errors.Is(err, context.DeadlineExceeded) {
+			reason = "secondary timed out"
+		}
+		logging.Warnf("Error forwarding %q to %s: %v", message.Command(), PortsList[1], err)
+		return wire.Reply(message, wire.StatusError, reason)
+	}
+	if Protocol == wire.Text {
+		// Text replies carry no status, so infer the one the client library
+		// would have seen.
+		status := wire.StatusOK
+		if response.Text == "NOT FOUND" {
+			status = wire.StatusNotFound
 		}
-		connectionMap[PortsList[1]] = conn
+		text := response.Text
+		response = wire.Reply(message, status, text)
+		response.Value, _ = strconv.Atoi(text)
 	}
+	if message.Op == wire.OpInsert && response.Status == wire.StatusOK && !response.Version.IsZero() {
+		// Whatever the client does after this write must be ordered after
+		// it here too.
+		database.HLC.Update(response.Version)
+	}
+	response.ID = message.ID
+	response.ClientID = message.ClientID
+	return response
+}
 
-	conn = connectionMap[PortsList[1]]
+func registerConnection(id string, conn *wire.Conn) {
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+	connectionMap[id] = conn
+}
 
-	writer := bufio.NewWriter(conn)
-	writer.WriteString(message + "\n")
-	writer.Flush()
+func lookupConnection(id string) (*wire.Conn, bool) {
+	connectionMutex.RLock()
+	defer connectionMutex.RUnlock()
+	conn, ok := connectionMap[id]
+	return conn, ok
 }
 
-func sendResponse(clientID string, response string) {
-	conn, ok := connectionMap[clientID]
-	if !ok {
-		return
+// releaseConnection drops every ID registered to a closed connection.
+func releaseConnection(conn *wire.Conn) {
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+	for id, registered := range connectionMap {
+		if registered == conn {
+			delete(connectionMap, id)
+		}
 	}
-	writer := bufio.NewWriter(conn)
-	writer.WriteString(response + "\n")
-	writer.Flush()
 }
 
-func dumpConnectionMap() {
+func isServerPort(id string) bool {
+	for _, port := range PortsList {
+		if id == port {
+			return true
+		}
+	}
+	return false
+}
+
+func listClients() []clientInfo {
+	connectionMutex.RLock()
+	defer connectionMutex.RUnlock()
+	clients := make([]clientInfo, 0, len(connectionMap))
 	for clientID, conn := range connectionMap {
-		println("Client " + clientID + " connected from " + conn.RemoteAddr().String())
+		clients = append(clients, clientInfo{ID: clientID, Address: conn.RemoteAddr().String()})
 	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
 }
 
-// Database functions
-func initializeDatabase() {
-	DB = make(map[int]int)
+func dumpConnectionMap() {
+	clients := listClients()
+	if len(clients) == 0 {
+		fmt.Println("No clients connected")
+	}
+	for _, client := range clients {
+		fmt.Println("Client " + client.ID + " connected from " + client.Address)
+	}
 }
 
-func Insert(key int, value int) {
-	Mutex.Lock()
-	defer Mutex.Unlock()
-	DB[key] = value
+// Admin and observability functions
+type clientInfo struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
 }
 
-func Lookup(key int) (int, bool) {
-	Mutex.RLock()
-	defer Mutex.RUnlock()
-	value, ok := DB[key]
-	return value, ok
+type debugInfo struct {
+	Port     string        `json:"port"`
+	Leader   bool          `json:"leader"`
+	Protocol string        `json:"protocol"`
+	Stats    stats.Summary `json:"stats"`
+	// KeysPerShard has no entry for a shard whose server did not answer.
+	KeysPerShard   map[string]int `json:"keys_per_shard"`
+	Storage        database.Usage `json:"storage"`
+	QueuedRequests int            `json:"queued_requests"`
+	Clients        []clientInfo   `json:"clients"`
+	Peers          []peer.Status  `json:"peers"`
+	Delay          string         `json:"delay"`
+	LogLevel       string         `json:"log_level"`
 }
 
-func Dump() string {
-	Mutex.RLock()
-	defer Mutex.RUnlock()
+func collectDebugInfo() debugInfo {
+	keysPerShard := make(map[string]int)
+	countShardKeys(Dump(database.Timestamp{}), keysPerShard)
+	countPeerShardKeys(keysPerShard)
+	return debugInfo{
+		Port:           PortsList[0],
+		Leader:         IsLeader,
+		Protocol:       Protocol.String(),
+		Stats:          stats.Snapshot(),
+		KeysPerShard:   keysPerShard,
+		Storage:        database.CurrentUsage(),
+		QueuedRequests: Workers.Queued(),
+		Clients:        listClients(),
+		Peers:          Peers.Statuses(),
+		Delay:          latency.Current().String(),
+		LogLevel:       logging.CurrentLevel().String(),
+	}
+}
+
+func handleStats() {
+	info := collectDebugInfo()
+	s := info.Stats
+	fmt.Printf("Uptime: %s\n", s.Uptime.Round(time.Second))
+	fmt.Printf("Requests: %d (%d errors), %.2f ops/sec overall, %.2f ops/sec recently\n",
+		s.Total, s.Errors, s.OpsPerSec, s.RecentOpsPerSec)
+	ops := make([]string, 0, len(s.ByOp))
+	for op, count := range s.ByOp {
+		ops = append(ops, fmt.Sprintf("%s=%d", op, count))
+	}
+	sort.Strings(ops)
+	fmt.Printf("By op: %s\n", strings.Join(ops, " "))
+	fmt.Printf("Forwarded: %d (%d failed)\n", s.Forwarded, s.ForwardErrors)
+	fmt.Printf("Latency: p50=%s p99=%s max=%s\n", s.P50.Round(time.Millisecond), s.P99.Round(time.Millisecond), s.Max.Round(time.Millisecond))
+	keys := make([]string, 0, 2)
+	for _, shard := range []string{"primary", "secondary"} {
+		if count, ok := info.KeysPerShard[shard]; ok {
+			keys = append(keys, fmt.Sprintf("%s=%d", shard, count))
+		} else {
+			keys = append(keys, shard+"=unreachable")
+		}
+	}
+	fmt.Printf("Keys: %s\n", strings.Join(keys, " "))
+	fmt.Printf("Storage: %d keys, ~%d bytes, %d expired, %d evicted, %d versions pruned\n",
+		info.Storage.Keys, info.Storage.Bytes, info.Storage.Expired, info.Storage.Evicted, info.Storage.Pruned)
+	fmt.Printf("Queued requests: %d\n", info.QueuedRequests)
+}
+
+// countPeerShardKeys asks the other server for its dictionary over the
+// peer link and counts the shards it reports that this server does not
+// hold. A leader's reply includes our own shard too, which was counted
+// already.
+func countPeerShardKeys(counts map[string]int) {
+	ctx, cancel := context.WithTimeout(context.Background(), ForwardTimeout)
+	defer cancel()
+	response, err := Peers.Request(ctx, PortsList[1], wire.Message{
+		Kind:     wire.KindRequest,
+		Op:       wire.OpDictionary,
+		ClientID: PortsList[0],
+	})
+	if err == nil && response.Status == wire.StatusError {
+		err = errors.New(response.Text)
+	}
+	if err != nil {
+		logging.Warnf("Error counting keys on %s: %v", PortsList[1], err)
+		return
+	}
+	peerCounts := make(map[string]int)
+	countShardKeys(response.Text, peerCounts)
+	for shard, count := range peerCounts {
+		if _, ok := counts[shard]; !ok {
+			counts[shard] = count
+		}
+	}
+}
+
+// countShardKeys counts the keys of each shard in a dictionary reply like
+// "primary {(1, 2), (3, 4)}, secondary {(2, 5)}".
+func countShardKeys(dump string, counts map[string]int) {
+	for _, shard := range []string{"primary", "secondary"} {
+		_, rest, ok := strings.Cut(dump, shard+" {")
+		if !ok {
+			continue
+		}
+		entries, _, _ := strings.Cut(rest, "}")
+		counts[shard] = strings.Count(entries, "(")
+	}
+}
+
+func handlePeers() {
+	for _, status := range Peers.Statuses() {
+		state := "down"
+		if status.Connected {
+			state = "connected"
+		}
+		line := fmt.Sprintf("Peer %s: %s, %d queued, %d reconnects", status.Port, state, status.Queued, status.Reconnects)
+		if !status.LastSeen.IsZero() {
+			line += fmt.Sprintf(", last seen %s ago", time.Since(status.LastSeen).Round(time.Millisecond))
+		}
+		if status.LastError != "" {
+			line += ", last error: " + status.LastError
+		}
+		fmt.Println(line)
+	}
+}
+
+func handleSnapshot() {
+	start := time.Now()
+	if err := database.TakeSnapshot(); err != nil {
+		fmt.Printf("Error taking snapshot: %v\n", err)
+		return
+	}
+	fmt.Printf("Snapshot written in %s\n", time.Since(start).Round(time.Millisecond))
+}
+
+func handleLogLevel(args []string) {
+	if len(args) == 0 {
+		fmt.Printf("Log level: %s\n", logging.CurrentLevel())
+		return
+	}
+	level, err := logging.ParseLevel(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	logging.SetLevel(level)
+	fmt.Printf("Log level set to %s\n", level)
+}
+
+func handleReloadCerts() {
+	if TLS == nil {
+		fmt.Println("TLS is not enabled")
+		return
+	}
+	if err := TLS.Reload(); err != nil {
+		fmt.Printf("Error reloading certificates: %v\n", err)
+		return
+	}
+	fmt.Println("Reloaded TLS certificates")
+}
+
+func startDebugServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(collectDebugInfo())
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logging.Errorf("Debug server on %s stopped: %v", addr, err)
+		}
+	}()
+	logging.Infof("Debug endpoint at http://%s/debug", addr)
+}
+
+// Database functions
+func Dump(at database.Timestamp) string {
+	snapshot := database.Snapshot(at)
 	result := ""
 
 	if IsLeader {
@@ -293,8 +905,8 @@ func Dump() string {
 		result = "secondary {"
 	}
 
-	keys := make([]int, 0, len(DB))
-	for key := range DB {
+	keys := make([]int, 0, len(snapshot))
+	for key := range snapshot {
 		keys = append(keys, key)
 	}
 	sort.Ints(keys)
@@ -303,8 +915,11 @@ func Dump() string {
 		if i > 0 {
 			result += ", "
 		}
-		result += fmt.Sprintf("(%d, %d)", key, DB[key])
+		result += fmt.Sprintf("(%d, %d)", key, snapshot[key])
 	}
 	result += "}"
+	if usage := database.CurrentUsage(); usage.Expired > 0 || usage.Evicted > 0 {
+		result += fmt.Sprintf(" (expired %d, evicted %d)", usage.Expired, usage.Evicted)
+	}
 	return result
 }
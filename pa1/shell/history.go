@@ -0,0 +1,109 @@
+package shell
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// History is the list of entered lines, oldest first, optionally kept in a
+// file between sessions.
+type History struct {
+	path string
+	size int
+
+	mu      sync.Mutex
+	entries []string
+}
+
+// loadHistory reads path if it exists. A missing or unreadable file starts
+// an empty history.
+func loadHistory(path string, size int) *History {
+	h := &History{path: path, size: size}
+	if path == "" {
+		return h
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return h
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	h.trimLocked()
+	return h
+}
+
+// Add appends line unless it repeats the previous entry.
+func (h *History) Add(line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.entries); n > 0 && h.entries[n-1] == line {
+		return
+	}
+	h.entries = append(h.entries, line)
+	h.trimLocked()
+}
+
+func (h *History) Entries() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.entries...)
+}
+
+func (h *History) Save() error {
+	if h.path == "" {
+		return nil
+	}
+	h.mu.Lock()
+	data := strings.Join(h.entries, "\n") + "\n"
+	h.mu.Unlock()
+	return os.WriteFile(h.path, []byte(data), 0o600)
+}
+
+func (h *History) trimLocked() {
+	if len(h.entries) > h.size {
+		h.entries = h.entries[len(h.entries)-h.size:]
+	}
+}
+
+// Browse starts moving through the history from the newest entry, for
+// the up and down keys while one line is edited.
+func (h *History) Browse() *Browser {
+	entries := h.Entries()
+	return &Browser{entries: entries, index: len(entries)}
+}
+
+// Browser walks a snapshot of the history. The line being typed before
+// browsing started is kept and comes back after the newest entry.
+type Browser struct {
+	entries []string
+	index   int
+	draft   string
+}
+
+// Previous returns the entry before the current one; current is the line
+// as edited so far.
+func (b *Browser) Previous(current string) string {
+	if b.index == len(b.entries) {
+		b.draft = current
+	}
+	if b.index == 0 {
+		return current
+	}
+	b.index--
+	return b.entries[b.index]
+}
+
+func (b *Browser) Next(current string) string {
+	if b.index == len(b.entries) {
+		return current
+	}
+	b.index++
+	if b.index == len(b.entries) {
+		return b.draft
+	}
+	return b.entries[b.index]
+}
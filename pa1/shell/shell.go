@@ -0,0 +1,320 @@
+// Package shell reads commands for the interactive client. On a terminal it
+// edits lines itself, with history and tab completion; otherwise it reads
+// plain lines, so scripts can be piped in.
+package shell
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrInterrupted is returned by ReadLine when the user presses Ctrl-C.
+var ErrInterrupted = errors.New("interrupted")
+
+// Completer returns the possible completions of line, which is the text
+// before the cursor. Each candidate is a whole replacement for line.
+type Completer func(line string) []string
+
+type Config struct {
+	Prompt string
+	// HistoryFile keeps history between sessions; empty disables saving.
+	HistoryFile string
+	// HistorySize caps the entries kept, 500 by default.
+	HistorySize int
+	Complete    Completer
+}
+
+type Shell struct {
+	config  Config
+	in      *os.File
+	out     *os.File
+	reader  *bufio.Reader
+	history *History
+	// restore is set while the terminal is in raw mode.
+	restore func() error
+
+	// mu guards the line being edited, which Write redraws around output
+	// printed from other goroutines.
+	mu      sync.Mutex
+	editing bool
+	line    []rune
+	cursor  int
+}
+
+// New reads from stdin and writes to stdout. Line editing is used only when
+// both are terminals.
+func New(config Config) *Shell {
+	if config.HistorySize <= 0 {
+		config.HistorySize = 500
+	}
+	s := &Shell{
+		config:  config,
+		in:      os.Stdin,
+		out:     os.Stdout,
+		reader:  bufio.NewReader(os.Stdin),
+		history: loadHistory(config.HistoryFile, config.HistorySize),
+	}
+	if isTerminal(int(s.in.Fd())) && isTerminal(int(s.out.Fd())) {
+		if restore, err := makeRaw(int(s.in.Fd())); err == nil {
+			s.restore = restore
+		}
+	}
+	return s
+}
+
+// Interactive reports whether lines are being edited on a terminal.
+func (s *Shell) Interactive() bool {
+	return s.restore != nil
+}
+
+// History returns the entries, oldest first.
+func (s *Shell) History() []string {
+	return s.history.Entries()
+}
+
+// Close puts the terminal back and saves the history.
+func (s *Shell) Close() error {
+	if s.restore != nil {
+		s.restore()
+		s.restore = nil
+	}
+	return s.history.Save()
+}
+
+// ReadLine returns the next line without its newline, or io.EOF once input
+// ends. Lines read from a terminal are added to the history.
+func (s *Shell) ReadLine() (string, error) {
+	if s.restore == nil {
+		line, err := s.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	line, err := s.edit()
+	if err == nil && strings.TrimSpace(line) != "" {
+		s.history.Add(line)
+	}
+	return line, err
+}
+
+// Write prints p above the line being edited, so replies that arrive while
+// the user types do not garble the prompt.
+func (s *Shell) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.editing {
+		return s.out.Write(p)
+	}
+	s.out.WriteString("\r\x1b[K")
+	n, err := s.out.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		s.out.WriteString("\n")
+	}
+	s.redrawLocked()
+	return n, err
+}
+
+func (s *Shell) edit() (string, error) {
+	s.mu.Lock()
+	s.editing, s.line, s.cursor = true, nil, 0
+	s.redrawLocked()
+	s.mu.Unlock()
+
+	browse := s.history.Browse()
+	for {
+		r, _, err := s.reader.ReadRune()
+		if err != nil {
+			s.finish("")
+			return "", err
+		}
+		s.mu.Lock()
+		switch r {
+		case '\r', '\n':
+			line := string(s.line)
+			s.mu.Unlock()
+			s.finish("\n")
+			return line, nil
+		case 3: // Ctrl-C
+			s.mu.Unlock()
+			s.finish("^C\n")
+			return "", ErrInterrupted
+		case 4: // Ctrl-D
+			if len(s.line) == 0 {
+				s.mu.Unlock()
+				s.finish("\n")
+				return "", io.EOF
+			}
+			s.deleteLocked(s.cursor, s.cursor+1)
+		case 1: // Ctrl-A
+			s.cursor = 0
+		case 5: // Ctrl-E
+			s.cursor = len(s.line)
+		case 2: // Ctrl-B
+			s.moveLocked(-1)
+		case 6: // Ctrl-F
+			s.moveLocked(1)
+		case 11: // Ctrl-K
+			s.deleteLocked(s.cursor, len(s.line))
+		case 21: // Ctrl-U
+			s.deleteLocked(0, s.cursor)
+		case 23: // Ctrl-W
+			start := s.cursor
+			for start > 0 && s.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && s.line[start-1] != ' ' {
+				start--
+			}
+			s.deleteLocked(start, s.cursor)
+		case 127, 8: // Backspace
+			if s.cursor > 0 {
+				s.deleteLocked(s.cursor-1, s.cursor)
+			}
+		case '\t':
+			s.completeLocked()
+		case 16: // Ctrl-P
+			s.setLineLocked(browse.Previous(string(s.line)))
+		case 14: // Ctrl-N
+			s.setLineLocked(browse.Next(string(s.line)))
+		case 27: // Escape sequence
+			s.mu.Unlock()
+			key := s.readEscape()
+			s.mu.Lock()
+			switch key {
+			case "[A":
+				s.setLineLocked(browse.Previous(string(s.line)))
+			case "[B":
+				s.setLineLocked(browse.Next(string(s.line)))
+			case "[C":
+				s.moveLocked(1)
+			case "[D":
+				s.moveLocked(-1)
+			case "[H", "[1~", "OH":
+				s.cursor = 0
+			case "[F", "[4~", "OF":
+				s.cursor = len(s.line)
+			case "[3~":
+				s.deleteLocked(s.cursor, s.cursor+1)
+			}
+		default:
+			if r >= ' ' && r != utf8.RuneError {
+				s.insertLocked([]rune{r})
+			}
+		}
+		s.redrawLocked()
+		s.mu.Unlock()
+	}
+}
+
+// readEscape reads the rest of an ANSI escape sequence: "[A" for up,
+// "[3~" for delete and so on.
+func (s *Shell) readEscape() string {
+	var sequence []byte
+	for len(sequence) < 8 {
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			break
+		}
+		sequence = append(sequence, b)
+		if len(sequence) > 1 && (b >= 'A' && b <= 'Z' || b == '~') {
+			break
+		}
+		if len(sequence) == 1 && b != '[' && b != 'O' {
+			break
+		}
+	}
+	return string(sequence)
+}
+
+// finish ends editing with the line as typed followed by suffix.
+func (s *Shell) finish(suffix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursor = len(s.line)
+	s.redrawLocked()
+	s.out.WriteString(suffix)
+	s.editing = false
+}
+
+func (s *Shell) redrawLocked() {
+	var b strings.Builder
+	b.WriteString("\r\x1b[K")
+	b.WriteString(s.config.Prompt)
+	b.WriteString(string(s.line))
+	if back := len(s.line) - s.cursor; back > 0 {
+		b.WriteString("\x1b[")
+		b.WriteString(strconv.Itoa(back))
+		b.WriteString("D")
+	}
+	s.out.WriteString(b.String())
+}
+
+func (s *Shell) insertLocked(runes []rune) {
+	line := make([]rune, 0, len(s.line)+len(runes))
+	line = append(line, s.line[:s.cursor]...)
+	line = append(line, runes...)
+	line = append(line, s.line[s.cursor:]...)
+	s.line = line
+	s.cursor += len(runes)
+}
+
+func (s *Shell) deleteLocked(from int, to int) {
+	if from < 0 || to > len(s.line) || from >= to {
+		return
+	}
+	s.line = append(s.line[:from], s.line[to:]...)
+	s.cursor = from
+}
+
+func (s *Shell) moveLocked(delta int) {
+	s.cursor = min(max(s.cursor+delta, 0), len(s.line))
+}
+
+func (s *Shell) setLineLocked(line string) {
+	s.line = []rune(line)
+	s.cursor = len(s.line)
+}
+
+// completeLocked replaces the text before the cursor with the only
+// completion, or with the longest prefix all completions share. When that
+// adds nothing the choices are listed under the prompt.
+func (s *Shell) completeLocked() {
+	if s.config.Complete == nil {
+		return
+	}
+	before := string(s.line[:s.cursor])
+	candidates := s.config.Complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(common) > len(before) {
+		s.deleteLocked(0, s.cursor)
+		s.insertLocked([]rune(common))
+		return
+	}
+	if len(candidates) == 1 {
+		return
+	}
+	var choices []string
+	for _, c := range candidates {
+		choices = append(choices, lastWord(strings.TrimRight(c, " ")))
+	}
+	s.out.WriteString("\r\n" + strings.Join(choices, "  ") + "\r\n")
+}
+
+func lastWord(line string) string {
+	return line[strings.LastIndexAny(line, " /")+1:]
+}
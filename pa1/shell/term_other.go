@@ -0,0 +1,15 @@
+//go:build !linux
+
+package shell
+
+import "errors"
+
+// Line editing needs raw terminal mode, which is only implemented for
+// Linux; elsewhere the shell reads plain lines.
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func() error, error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
@@ -0,0 +1,125 @@
+// Package stats counts requests served by a server and keeps a window of
+// recent latencies for percentiles.
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const sampleSize = 4096
+const rateWindow = 10
+
+type Summary struct {
+	Uptime          time.Duration    `json:"uptime_ns"`
+	Total           int64            `json:"total"`
+	Errors          int64            `json:"errors"`
+	ByOp            map[string]int64 `json:"by_op"`
+	Forwarded       int64            `json:"forwarded"`
+	ForwardErrors   int64            `json:"forward_errors"`
+	OpsPerSec       float64          `json:"ops_per_sec"`
+	RecentOpsPerSec float64          `json:"recent_ops_per_sec"`
+	P50             time.Duration    `json:"p50_ns"`
+	P99             time.Duration    `json:"p99_ns"`
+	Max             time.Duration    `json:"max_ns"`
+}
+
+var (
+	mutex         sync.Mutex
+	started       = time.Now()
+	total         int64
+	errorCount    int64
+	byOp          = make(map[string]int64)
+	forwarded     int64
+	forwardErrors int64
+
+	// Ring of the most recent latencies.
+	samples    = make([]time.Duration, 0, sampleSize)
+	nextSample int
+
+	// Per-second request counts for the last rateWindow seconds.
+	buckets     [rateWindow]int64
+	bucketTimes [rateWindow]int64
+)
+
+// Record counts one served request and how long it took end to end.
+func Record(op string, latency time.Duration, failed bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	total++
+	byOp[op]++
+	if failed {
+		errorCount++
+	}
+
+	if len(samples) < sampleSize {
+		samples = append(samples, latency)
+	} else {
+		samples[nextSample] = latency
+		nextSample = (nextSample + 1) % sampleSize
+	}
+
+	now := time.Now().Unix()
+	i := now % rateWindow
+	if bucketTimes[i] != now {
+		bucketTimes[i] = now
+		buckets[i] = 0
+	}
+	buckets[i]++
+}
+
+// RecordForward counts a request the leader relayed to the secondary.
+func RecordForward(failed bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	forwarded++
+	if failed {
+		forwardErrors++
+	}
+}
+
+func Snapshot() Summary {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	summary := Summary{
+		Uptime:        time.Since(started),
+		Total:         total,
+		Errors:        errorCount,
+		ByOp:          make(map[string]int64, len(byOp)),
+		Forwarded:     forwarded,
+		ForwardErrors: forwardErrors,
+	}
+	for op, count := range byOp {
+		summary.ByOp[op] = count
+	}
+	if seconds := summary.Uptime.Seconds(); seconds > 0 {
+		summary.OpsPerSec = float64(total) / seconds
+	}
+
+	// Only count full seconds, so the current partial second does not drag
+	// the rate down.
+	now := time.Now().Unix()
+	var recent int64
+	for i := range buckets {
+		if age := now - bucketTimes[i]; age >= 1 && age <= rateWindow-1 {
+			recent += buckets[i]
+		}
+	}
+	summary.RecentOpsPerSec = float64(recent) / float64(rateWindow-1)
+
+	if len(samples) > 0 {
+		sorted := append([]time.Duration(nil), samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		summary.P50 = percentile(sorted, 0.50)
+		summary.P99 = percentile(sorted, 0.99)
+		summary.Max = sorted[len(sorted)-1]
+	}
+	return summary
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
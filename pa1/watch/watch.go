@@ -0,0 +1,280 @@
+// Package watch pushes a notification to every connection watching a key
+// whenever an insert to that key commits.
+package watch
+
+import (
+	"errors"
+	"pa1/database"
+	"pa1/wire"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrClosed = errors.New("watcher closed")
+
+// QueueSize is how many notifications a connection may fall behind by
+// before its watches are cancelled.
+const QueueSize = 1024
+
+// Pattern is "5" for a single key or "5*" for every key whose decimal form
+// starts with 5.
+type Pattern string
+
+func (p Pattern) IsPrefix() bool {
+	return strings.HasSuffix(string(p), "*")
+}
+
+func (p Pattern) Match(key int) bool {
+	if prefix, ok := strings.CutSuffix(string(p), "*"); ok {
+		return strings.HasPrefix(strconv.Itoa(key), prefix)
+	}
+	return string(p) == strconv.Itoa(key)
+}
+
+// Key returns the watched key of a single-key pattern.
+func (p Pattern) Key() (int, bool) {
+	if p.IsPrefix() {
+		return 0, false
+	}
+	key, err := strconv.Atoi(string(p))
+	return key, err == nil
+}
+
+// Several clients can share one connection (the leader's link to the
+// secondary carries everyone's forwarded watches), so registrations are
+// keyed by client as well as pattern.
+type registrationKey struct {
+	clientID string
+	pattern  Pattern
+}
+
+type registration struct {
+	id      uint64
+	since   database.Timestamp
+	forward bool
+	// lastRelayed is the newest version relayed from the secondary, so
+	// replays after a re-subscribe are not delivered twice.
+	lastRelayed database.Timestamp
+}
+
+type Hub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+// Watcher holds the watches of one connection and writes their
+// notifications, in commit order, from its own goroutine.
+type Watcher struct {
+	hub   *Hub
+	send  func(wire.Message) error
+	queue chan wire.Message
+
+	mu            sync.Mutex
+	registrations map[registrationKey]*registration
+	closed        bool
+	lagged        bool
+}
+
+func NewHub() *Hub {
+	return &Hub{watchers: make(map[*Watcher]struct{})}
+}
+
+func (h *Hub) NewWatcher(send func(wire.Message) error) *Watcher {
+	w := &Watcher{
+		hub:           h,
+		send:          send,
+		queue:         make(chan wire.Message, QueueSize),
+		registrations: make(map[registrationKey]*registration),
+	}
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+	go w.run()
+	return w
+}
+
+// Publish notifies every local watch matching the committed change. It is
+// called with the database write lock held.
+func (h *Hub) Publish(change database.Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.mu.Lock()
+		for key, r := range w.registrations {
+			if key.pattern.Match(change.Key) {
+				w.enqueueLocked(notification(key, r, change))
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Relay delivers a notification the secondary sent for a forwarded watch to
+// the watcher that registered it. It reports whether anyone was waiting.
+func (h *Hub) Relay(message wire.Message) bool {
+	key := registrationKey{clientID: message.ClientID, pattern: Pattern(message.Text)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.mu.Lock()
+		r, ok := w.registrations[key]
+		if ok && r.forward {
+			if r.lastRelayed.Before(message.Version) {
+				r.lastRelayed = message.Version
+				message.ID = r.id
+				w.enqueueLocked(message)
+			}
+			w.mu.Unlock()
+			return true
+		}
+		w.mu.Unlock()
+	}
+	return false
+}
+
+// Forwarded returns a watch request for every forwarded watch, resuming
+// after the last version relayed, for re-subscribing after the link to the
+// secondary comes back.
+func (h *Hub) Forwarded() []wire.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var requests []wire.Message
+	for w := range h.watchers {
+		w.mu.Lock()
+		for key, r := range w.registrations {
+			if !r.forward {
+				continue
+			}
+			since := r.since
+			if since.Before(r.lastRelayed) {
+				since = r.lastRelayed
+			}
+			requests = append(requests, watchRequest(wire.OpWatch, key, since))
+		}
+		w.mu.Unlock()
+	}
+	return requests
+}
+
+// Watch registers request's pattern. When the request carries a version,
+// every matching change after it is queued first. forward marks watches
+// whose notifications will also be relayed from the secondary. Watching a
+// pattern again replaces the old registration.
+func (w *Watcher) Watch(request wire.Message, forward bool) error {
+	key := registrationKey{clientID: request.ClientID, pattern: Pattern(request.Text)}
+	var err error
+	database.ChangesSince(request.Version, key.pattern.Match, func(history []database.Change) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.closed {
+			err = ErrClosed
+			return
+		}
+		r := &registration{id: request.ID, since: request.Version, forward: forward}
+		w.registrations[key] = r
+		for _, change := range history {
+			w.enqueueLocked(notification(key, r, change))
+		}
+	})
+	return err
+}
+
+// Unwatch removes a registration and reports whether it was forwarded.
+func (w *Watcher) Unwatch(request wire.Message) (found bool, forwarded bool) {
+	key := registrationKey{clientID: request.ClientID, pattern: Pattern(request.Text)}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r, ok := w.registrations[key]
+	if !ok {
+		return false, false
+	}
+	delete(w.registrations, key)
+	return true, r.forward
+}
+
+// Close stops the watcher and returns unwatch requests for its forwarded
+// watches, which the caller should pass on to the secondary.
+func (w *Watcher) Close() []wire.Message {
+	w.hub.mu.Lock()
+	delete(w.hub.watchers, w)
+	w.hub.mu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var unwatches []wire.Message
+	for key, r := range w.registrations {
+		if r.forward {
+			unwatches = append(unwatches, watchRequest(wire.OpUnwatch, key, database.Timestamp{}))
+		}
+	}
+	w.registrations = make(map[registrationKey]*registration)
+	w.closeLocked()
+	return unwatches
+}
+
+// enqueueLocked never blocks, because it runs under the database lock. A
+// watcher that falls a full queue behind has its watches cancelled and is
+// told so once the queue drains; the client resumes from the last version
+// it saw.
+func (w *Watcher) enqueueLocked(message wire.Message) {
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- message:
+	default:
+		w.lagged = true
+		w.closeLocked()
+	}
+}
+
+func (w *Watcher) closeLocked() {
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+}
+
+func (w *Watcher) run() {
+	var err error
+	for message := range w.queue {
+		if err == nil {
+			err = w.send(message)
+		}
+	}
+	w.mu.Lock()
+	lagged := w.lagged
+	w.mu.Unlock()
+	if lagged && err == nil {
+		w.send(wire.Message{
+			Kind:   wire.KindNotification,
+			Op:     wire.OpWatch,
+			Status: wire.StatusError,
+			Text:   "watch cancelled: notifications fell behind",
+		})
+	}
+}
+
+func notification(key registrationKey, r *registration, change database.Change) wire.Message {
+	return wire.Message{
+		Kind:     wire.KindNotification,
+		ID:       r.id,
+		Op:       wire.OpWatch,
+		ClientID: key.clientID,
+		Key:      change.Key,
+		Value:    change.Version.Value,
+		Version:  change.Version.Timestamp,
+		Text:     string(key.pattern),
+	}
+}
+
+func watchRequest(op wire.Op, key registrationKey, since database.Timestamp) wire.Message {
+	return wire.Message{
+		Kind:     wire.KindRequest,
+		Op:       op,
+		ClientID: key.clientID,
+		Version:  since,
+		Text:     string(key.pattern),
+	}
+}
@@ -0,0 +1,98 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Binary frames are [length uint32][body], where body is
+//
+//	kind u8 | op u8 | status u8 | reserved u8 | id u64 | key i64 | value i64 |
+//	version wall i64 | version logical i32 | ttl ms i64 |
+//	client id (u16 length + bytes) | text (u32 length + bytes)
+//
+// All integers are big endian.
+
+const fixedBodySize = 4 + 8 + 8 + 8 + 8 + 4 + 8
+const MaxFrameSize = 16 << 20
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+func Encode(m Message) ([]byte, error) {
+	if len(m.ClientID) > 0xFFFF {
+		return nil, fmt.Errorf("client id too long")
+	}
+	bodySize := fixedBodySize + 2 + len(m.ClientID) + 4 + len(m.Text)
+	if bodySize > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	buf := make([]byte, 4+bodySize)
+	binary.BigEndian.PutUint32(buf[0:], uint32(bodySize))
+	body := buf[4:]
+	body[0] = byte(m.Kind)
+	body[1] = byte(m.Op)
+	body[2] = byte(m.Status)
+	binary.BigEndian.PutUint64(body[4:], m.ID)
+	binary.BigEndian.PutUint64(body[12:], uint64(int64(m.Key)))
+	binary.BigEndian.PutUint64(body[20:], uint64(int64(m.Value)))
+	binary.BigEndian.PutUint64(body[28:], uint64(m.Version.Wall))
+	binary.BigEndian.PutUint32(body[36:], uint32(m.Version.Logical))
+	binary.BigEndian.PutUint64(body[40:], uint64(m.TTL.Milliseconds()))
+	offset := fixedBodySize
+	binary.BigEndian.PutUint16(body[offset:], uint16(len(m.ClientID)))
+	offset += 2
+	offset += copy(body[offset:], m.ClientID)
+	binary.BigEndian.PutUint32(body[offset:], uint32(len(m.Text)))
+	offset += 4
+	copy(body[offset:], m.Text)
+	return buf, nil
+}
+
+func Decode(r io.Reader) (Message, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxFrameSize {
+		return Message{}, ErrFrameTooLarge
+	}
+	if size < fixedBodySize+6 {
+		return Message{}, fmt.Errorf("frame too short: %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Message{}, err
+	}
+
+	m := Message{
+		Kind:   Kind(body[0]),
+		Op:     Op(body[1]),
+		Status: Status(body[2]),
+		ID:     binary.BigEndian.Uint64(body[4:]),
+		Key:    int(int64(binary.BigEndian.Uint64(body[12:]))),
+		Value:  int(int64(binary.BigEndian.Uint64(body[20:]))),
+	}
+	m.Version.Wall = int64(binary.BigEndian.Uint64(body[28:]))
+	m.Version.Logical = int32(binary.BigEndian.Uint32(body[36:]))
+	m.TTL = time.Duration(int64(binary.BigEndian.Uint64(body[40:]))) * time.Millisecond
+
+	offset := fixedBodySize
+	clientLen := int(binary.BigEndian.Uint16(body[offset:]))
+	offset += 2
+	if offset+clientLen+4 > len(body) {
+		return Message{}, fmt.Errorf("malformed frame")
+	}
+	m.ClientID = string(body[offset : offset+clientLen])
+	offset += clientLen
+	textLen := int(binary.BigEndian.Uint32(body[offset:]))
+	offset += 4
+	if offset+textLen != len(body) {
+		return Message{}, fmt.Errorf("malformed frame")
+	}
+	m.Text = string(body[offset:])
+	return m, nil
+}
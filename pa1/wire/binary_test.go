@@ -0,0 +1,146 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"pa1/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+var allKinds = []Kind{KindRequest, KindResponse, KindNotification}
+
+var allOps = []Op{OpInvalid, OpPing, OpInsert, OpLookup, OpDictionary, OpHeartbeat, OpWatch, OpUnwatch, OpAuth}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, kind := range allKinds {
+		for _, op := range allOps {
+			for _, status := range []Status{StatusOK, StatusNotFound, StatusError} {
+				m := Message{
+					Kind:     kind,
+					ID:       1<<40 + uint64(op),
+					Op:       op,
+					Status:   status,
+					ClientID: "client-" + op.String(),
+					Key:      -7,
+					Value:    1 << 40,
+					Version:  database.Timestamp{Wall: 1700000000123, Logical: 4},
+					TTL:      1500 * time.Millisecond,
+					Text:     "some text, with spaces\nand a newline",
+				}
+				frame, err := Encode(m)
+				if err != nil {
+					t.Fatalf("Encode(%+v): %v", m, err)
+				}
+				got, err := Decode(bytes.NewReader(frame))
+				if err != nil {
+					t.Fatalf("Decode of %+v: %v", m, err)
+				}
+				if got != m {
+					t.Errorf("round trip of kind %d %s %s:\n got %+v\nwant %+v", kind, op, status, got, m)
+				}
+			}
+		}
+	}
+}
+
+func TestBinaryRoundTripEmptyFields(t *testing.T) {
+	m := Message{Kind: KindRequest, Op: OpPing}
+	frame, err := Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(bytes.NewReader(frame))
+	if err != nil || got != m {
+		t.Errorf("Decode = %+v, %v, want %+v", got, err, m)
+	}
+}
+
+func TestBinaryDecodesBackToBack(t *testing.T) {
+	var stream bytes.Buffer
+	for i, op := range allOps {
+		frame, err := Encode(Message{Kind: KindRequest, ID: uint64(i), Op: op})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(frame)
+	}
+	for i, op := range allOps {
+		got, err := Decode(&stream)
+		if err != nil || got.ID != uint64(i) || got.Op != op {
+			t.Fatalf("message %d = %+v, %v, want op %s", i, got, err, op)
+		}
+	}
+	if _, err := Decode(&stream); err != io.EOF {
+		t.Errorf("Decode at the end of the stream = %v, want io.EOF", err)
+	}
+}
+
+func TestBinaryTruncatedFrames(t *testing.T) {
+	frame, err := Encode(Message{Kind: KindRequest, Op: OpInsert, ClientID: "c1", Key: 1, Value: 2, Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty stream is a clean end; every other cut is an error.
+	for n := 1; n < len(frame); n++ {
+		if got, err := Decode(bytes.NewReader(frame[:n])); err == nil {
+			t.Errorf("Decode of the first %d of %d bytes = %+v, want an error", n, len(frame), got)
+		}
+	}
+}
+
+func TestBinaryOversizedFrames(t *testing.T) {
+	if _, err := Encode(Message{Text: strings.Repeat("x", MaxFrameSize)}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Encode of an oversized text = %v, want ErrFrameTooLarge", err)
+	}
+	if _, err := Encode(Message{ClientID: strings.Repeat("x", 0x10000)}); err == nil {
+		t.Error("Encode of an oversized client ID succeeded")
+	}
+
+	// The declared length is checked before anything is allocated.
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, MaxFrameSize+1)
+	if _, err := Decode(bytes.NewReader(header)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Decode of an oversized frame = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestBinaryMalformedFrames(t *testing.T) {
+	frame, err := Encode(Message{Kind: KindRequest, Op: OpLookup, ClientID: "c1", Text: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientLen := 4 + fixedBodySize
+
+	tests := []struct {
+		name   string
+		mutate func(frame []byte) []byte
+	}{
+		{"shorter than the fixed fields", func(frame []byte) []byte {
+			short := make([]byte, 4+fixedBodySize)
+			binary.BigEndian.PutUint32(short, fixedBodySize)
+			return short
+		}},
+		{"client ID past the end", func(frame []byte) []byte {
+			binary.BigEndian.PutUint16(frame[clientLen:], 0xFFFF)
+			return frame
+		}},
+		{"text past the end", func(frame []byte) []byte {
+			binary.BigEndian.PutUint32(frame[clientLen+2+2:], 1000)
+			return frame
+		}},
+		{"trailing bytes after the text", func(frame []byte) []byte {
+			binary.BigEndian.PutUint32(frame[clientLen+2+2:], 1)
+			return frame
+		}},
+	}
+	for _, test := range tests {
+		mutated := test.mutate(append([]byte(nil), frame...))
+		if got, err := Decode(bytes.NewReader(mutated)); err == nil {
+			t.Errorf("%s: Decode = %+v, want an error", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package wire
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+type Protocol int
+
+const (
+	Binary Protocol = iota
+	Text
+)
+
+func ParseProtocol(name string) (Protocol, error) {
+	switch name {
+	case "binary":
+		return Binary, nil
+	case "text":
+		return Text, nil
+	}
+	return Binary, fmt.Errorf("unknown protocol %q", name)
+}
+
+func (p Protocol) String() string {
+	if p == Text {
+		return "text"
+	}
+	return "binary"
+}
+
+// Conn wraps a connection with a codec. Writes are serialized so many
+// goroutines can answer pipelined requests on the same connection.
+type Conn struct {
+	net.Conn
+	Protocol Protocol
+	reader   *bufio.Reader
+	writeMu  sync.Mutex
+}
+
+func NewConn(conn net.Conn, protocol Protocol) *Conn {
+	return &Conn{
+		Conn:     conn,
+		Protocol: protocol,
+		reader:   bufio.NewReader(conn),
+	}
+}
+
+// Read returns the next message. Read must not be called concurrently.
+func (c *Conn) Read() (Message, error) {
+	if c.Protocol == Binary {
+		return Decode(c.reader)
+	}
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return Message{}, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		return ParseText(line), nil
+	}
+}
+
+// ReadLine reads a raw text line, for text protocol peers that read replies.
+func (c *Conn) ReadLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+// WriteLine writes a raw text protocol line.
+func (c *Conn) WriteLine(line string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write([]byte(line + "\n"))
+	return err
+}
+
+func (c *Conn) Write(m Message) error {
+	if c.Protocol == Text {
+		return c.WriteLine(FormatText(m))
+	}
+	buf, err := Encode(m)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.Conn.Write(buf)
+	return err
+}
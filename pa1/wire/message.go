@@ -0,0 +1,144 @@
+package wire
+
+import (
+	"fmt"
+	"pa1/database"
+	"strings"
+	"time"
+)
+
+type Kind byte
+
+const (
+	KindRequest Kind = iota + 1
+	KindResponse
+	// KindNotification is pushed by the server for a watched key, carrying
+	// the ID of the watch request it belongs to.
+	KindNotification
+)
+
+type Op byte
+
+const (
+	OpInvalid Op = iota
+	OpPing
+	OpInsert
+	OpLookup
+	OpDictionary
+	OpHeartbeat
+	OpWatch
+	OpUnwatch
+	OpAuth
+)
+
+type Status byte
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusError
+)
+
+// Message is a single request or response. Which fields are meaningful
+// depends on Op: Key, Value and TTL for insert, plus Version when the leader
+// forwards it and in a binary reply, where it is the commit version; Key and
+// Version for lookup; Version for dictionary. Watch and unwatch carry their
+// pattern in Text, "5" for a single key or "5*" for a prefix, and watch
+// resumes after Version. Auth carries "<name> <mac>" in Text, see package
+// auth. Text carries the human readable reply, which is exactly what the
+// text protocol sends on the wire.
+type Message struct {
+	Kind     Kind
+	ID       uint64
+	Op       Op
+	Status   Status
+	ClientID string
+	Key      int
+	Value    int
+	Version  database.Timestamp
+	// TTL is how long an inserted value lives; zero means forever.
+	TTL  time.Duration
+	Text string
+}
+
+func (op Op) String() string {
+	switch op {
+	case OpPing:
+		return "ping"
+	case OpInsert:
+		return "insert"
+	case OpLookup:
+		return "lookup"
+	case OpDictionary:
+		return "dictionary"
+	case OpHeartbeat:
+		return "heartbeat"
+	case OpWatch:
+		return "watch"
+	case OpUnwatch:
+		return "unwatch"
+	case OpAuth:
+		return "auth"
+	}
+	return "invalid"
+}
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not found"
+	}
+	return "error"
+}
+
+// Command renders a request without its client ID, as typed by a user.
+func (m Message) Command() string {
+	version := ""
+	if !m.Version.IsZero() {
+		version = " @" + m.Version.String()
+	}
+	switch m.Op {
+	case OpInsert:
+		if m.TTL > 0 {
+			return fmt.Sprintf("insert %d %d ttl=%s%s", m.Key, m.Value, m.TTL, version)
+		}
+		return fmt.Sprintf("insert %d %d%s", m.Key, m.Value, version)
+	case OpLookup:
+		return fmt.Sprintf("lookup %d%s", m.Key, version)
+	case OpDictionary:
+		return "dictionary" + version
+	case OpPing:
+		return "ping"
+	case OpHeartbeat:
+		return "heartbeat"
+	case OpWatch:
+		return "watch " + patternArgs(m.Text) + version
+	case OpUnwatch:
+		return "unwatch " + patternArgs(m.Text)
+	case OpAuth:
+		return "auth " + m.Text
+	}
+	return m.Text
+}
+
+func patternArgs(pattern string) string {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return "prefix " + prefix
+	}
+	return pattern
+}
+
+func Reply(req Message, status Status, text string) Message {
+	return Message{
+		Kind:     KindResponse,
+		ID:       req.ID,
+		Op:       req.Op,
+		Status:   status,
+		ClientID: req.ClientID,
+		Key:      req.Key,
+		Version:  req.Version,
+		Text:     text,
+	}
+}
@@ -0,0 +1,212 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"pa1/database"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidVersion = errors.New("invalid version")
+var errInvalidTTL = errors.New("invalid ttl")
+var errInvalidPrefix = errors.New("invalid prefix")
+
+// ParseText parses a newline-free text protocol line of the form
+// "<clientID> <command> [args...]". Lines that fail to parse come back as
+// OpInvalid requests whose Text is the error to send to the client.
+func ParseText(line string) Message {
+	args := strings.Split(strings.TrimSpace(line), " ")
+	m := Message{Kind: KindRequest, ClientID: args[0]}
+
+	if len(args) < 2 {
+		m.Text = "invalid command"
+		return m
+	}
+
+	switch args[1] {
+	case "ping":
+		m.Op = OpPing
+	case "heartbeat":
+		m.Op = OpHeartbeat
+	case "insert":
+		// insert <key> <value> [ttl=<duration>] [@version], where only the
+		// leader sends a version, on inserts it forwards.
+		if len(args) < 4 || len(args) > 6 {
+			m.Text = "missing parameters"
+			return m
+		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			m.Text = "invalid key"
+			return m
+		}
+		value, err := strconv.Atoi(args[3])
+		if err != nil {
+			m.Text = "invalid value"
+			return m
+		}
+		rest := args[4:]
+		var version database.Timestamp
+		if len(rest) > 0 && strings.HasPrefix(rest[len(rest)-1], "@") {
+			version, err = ParseVersionArg(rest[len(rest)-1:])
+			if err != nil {
+				m.Text = err.Error()
+				return m
+			}
+			rest = rest[:len(rest)-1]
+		}
+		ttl, err := ParseTTLArg(rest)
+		if err != nil {
+			m.Text = err.Error()
+			return m
+		}
+		m.Op, m.Key, m.Value, m.TTL, m.Version = OpInsert, key, value, ttl, version
+	case "lookup":
+		if len(args) != 3 && len(args) != 4 {
+			m.Text = "error"
+			return m
+		}
+		key, err := strconv.Atoi(args[2])
+		if err != nil {
+			m.Text = "invalid key"
+			return m
+		}
+		version, err := ParseVersionArg(args[3:])
+		if err != nil {
+			m.Text = err.Error()
+			return m
+		}
+		m.Op, m.Key, m.Version = OpLookup, key, version
+	case "watch", "unwatch":
+		pattern, rest, err := parsePatternArgs(args[2:])
+		if err != nil {
+			m.Text = err.Error()
+			return m
+		}
+		if args[1] == "unwatch" {
+			if len(rest) > 0 {
+				m.Text = "error"
+				return m
+			}
+			m.Op, m.Text = OpUnwatch, pattern
+			m.Key, _ = strconv.Atoi(pattern)
+			break
+		}
+		version, err := ParseVersionArg(rest)
+		if err != nil {
+			m.Text = err.Error()
+			return m
+		}
+		m.Op, m.Text, m.Version = OpWatch, pattern, version
+		m.Key, _ = strconv.Atoi(pattern)
+	case "auth":
+		if len(args) != 4 {
+			m.Text = "missing parameters"
+			return m
+		}
+		m.Op, m.Text = OpAuth, args[2]+" "+args[3]
+	case "notify":
+		// <clientID> notify <pattern> <key> <value> @<version>
+		if len(args) != 6 {
+			m.Text = "missing parameters"
+			return m
+		}
+		key, err := strconv.Atoi(args[3])
+		if err != nil {
+			m.Text = "invalid key"
+			return m
+		}
+		value, err := strconv.Atoi(args[4])
+		if err != nil {
+			m.Text = "invalid value"
+			return m
+		}
+		version, err := ParseVersionArg(args[5:])
+		if err != nil {
+			m.Text = err.Error()
+			return m
+		}
+		m.Kind, m.Op, m.Text, m.Key, m.Value, m.Version = KindNotification, OpWatch, args[2], key, value, version
+	case "dictionary":
+		version, err := ParseVersionArg(args[2:])
+		if err != nil {
+			m.Text = err.Error()
+			return m
+		}
+		m.Op, m.Version = OpDictionary, version
+	default:
+		m.Text = "invalid command"
+	}
+	return m
+}
+
+// FormatText renders a message as a text protocol line without the newline.
+func FormatText(m Message) string {
+	if m.Kind == KindResponse {
+		return m.Text
+	}
+	if m.Kind == KindNotification && m.Status == StatusError {
+		return m.Text
+	}
+	if m.Kind == KindNotification {
+		return fmt.Sprintf("%s notify %s %d %d @%s", m.ClientID, m.Text, m.Key, m.Value, m.Version)
+	}
+	return m.ClientID + " " + m.Command()
+}
+
+// ParseVersionArg parses an optional trailing "@version" argument.
+func ParseVersionArg(args []string) (database.Timestamp, error) {
+	if len(args) == 0 {
+		return database.Timestamp{}, nil
+	}
+	if len(args) > 1 || !strings.HasPrefix(args[0], "@") {
+		return database.Timestamp{}, errInvalidVersion
+	}
+	return database.ParseTimestamp(args[0])
+}
+
+// ParseTTLArg parses an optional trailing "ttl=<duration>" argument. A bare
+// number is taken as seconds.
+func ParseTTLArg(args []string) (time.Duration, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	spec, ok := strings.CutPrefix(args[0], "ttl=")
+	if len(args) > 1 || !ok {
+		return 0, errInvalidTTL
+	}
+	if seconds, err := strconv.Atoi(spec); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(spec)
+	if err != nil || ttl < time.Millisecond {
+		return 0, errInvalidTTL
+	}
+	return ttl, nil
+}
+
+// parsePatternArgs parses "<key>" or "prefix <digits>" into a watch pattern
+// and returns the arguments after it.
+func parsePatternArgs(args []string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, errors.New("missing parameters")
+	}
+	if args[0] != "prefix" {
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			return "", nil, errors.New("invalid key")
+		}
+		return args[0], args[1:], nil
+	}
+	if len(args) < 2 {
+		return "", nil, errors.New("missing parameters")
+	}
+	prefix := args[1]
+	for i, r := range prefix {
+		if (r < '0' || r > '9') && !(r == '-' && i == 0) {
+			return "", nil, errInvalidPrefix
+		}
+	}
+	return prefix + "*", args[2:], nil
+}
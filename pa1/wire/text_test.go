@@ -0,0 +1,118 @@
+package wire
+
+import (
+	"pa1/database"
+	"testing"
+	"time"
+)
+
+func TestTextRoundTrip(t *testing.T) {
+	version := database.Timestamp{Wall: 1700000000123, Logical: 4}
+	tests := []Message{
+		{Kind: KindRequest, Op: OpPing},
+		{Kind: KindRequest, Op: OpHeartbeat},
+		{Kind: KindRequest, Op: OpInsert, Key: 1, Value: -2},
+		{Kind: KindRequest, Op: OpInsert, Key: 1, Value: 2, TTL: 1500 * time.Millisecond},
+		{Kind: KindRequest, Op: OpInsert, Key: 4, Value: 2, Version: version},
+		{Kind: KindRequest, Op: OpInsert, Key: 4, Value: 2, TTL: time.Minute, Version: version},
+		{Kind: KindRequest, Op: OpLookup, Key: -3},
+		{Kind: KindRequest, Op: OpLookup, Key: 3, Version: version},
+		{Kind: KindRequest, Op: OpDictionary},
+		{Kind: KindRequest, Op: OpDictionary, Version: version},
+		{Kind: KindRequest, Op: OpWatch, Key: 5, Text: "5"},
+		{Kind: KindRequest, Op: OpWatch, Key: 5, Text: "5", Version: version},
+		{Kind: KindRequest, Op: OpWatch, Text: "12*", Version: version},
+		{Kind: KindRequest, Op: OpWatch, Text: "-1*"},
+		{Kind: KindRequest, Op: OpUnwatch, Key: 5, Text: "5"},
+		{Kind: KindRequest, Op: OpUnwatch, Text: "12*"},
+		{Kind: KindRequest, Op: OpAuth, Text: "alice 0123abcd"},
+		{Kind: KindNotification, Op: OpWatch, Key: 12, Value: 7, Text: "1*", Version: version},
+	}
+	for _, m := range tests {
+		m.ClientID = "client-1"
+		line := FormatText(m)
+		if got := ParseText(line); got != m {
+			t.Errorf("round trip of %q:\n got %+v\nwant %+v", line, got, m)
+		}
+	}
+}
+
+func TestTextResponsesAreTheirText(t *testing.T) {
+	for _, op := range allOps {
+		m := Message{Kind: KindResponse, Op: op, ClientID: "client-1", Key: 1, Text: "Success"}
+		if got := FormatText(m); got != m.Text {
+			t.Errorf("FormatText of a %s response = %q, want %q", op, got, m.Text)
+		}
+	}
+	failed := Message{Kind: KindNotification, Status: StatusError, Text: "watch cancelled"}
+	if got := FormatText(failed); got != failed.Text {
+		t.Errorf("FormatText of a failed notification = %q, want %q", got, failed.Text)
+	}
+}
+
+func TestTextRejectsBadArguments(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"c1", "invalid command"},
+		{"c1 frobnicate", "invalid command"},
+		{"c1 insert 1", "missing parameters"},
+		{"c1 insert 1 2 ttl=5s @1 extra", "missing parameters"},
+		{"c1 insert x 2", "invalid key"},
+		{"c1 insert 1 x", "invalid value"},
+		{"c1 insert 1 2 5s", "invalid ttl"},
+		{"c1 insert 1 2 ttl=", "invalid ttl"},
+		{"c1 insert 1 2 ttl=abc", "invalid ttl"},
+		{"c1 insert 1 2 ttl=0", "invalid ttl"},
+		{"c1 insert 1 2 ttl=-5", "invalid ttl"},
+		{"c1 insert 1 2 ttl=500us", "invalid ttl"},
+		{"c1 insert 1 2 ttl=5s ttl=6s", "invalid ttl"},
+		{"c1 insert 1 2 @abc", `invalid version "abc"`},
+		{"c1 insert 1 2 @1.2 ttl=5s", "invalid ttl"},
+		{"c1 lookup", "error"},
+		{"c1 lookup x", "invalid key"},
+		{"c1 lookup 1 5", "invalid version"},
+		{"c1 lookup 1 @", `invalid version ""`},
+		{"c1 lookup 1 @-1", `invalid version "-1"`},
+		{"c1 lookup 1 @1.-2", `invalid version "1.-2"`},
+		{"c1 lookup 1 @1.x", `invalid version "1.x"`},
+		{"c1 dictionary @1 @2", "invalid version"},
+		{"c1 dictionary 1", "invalid version"},
+		{"c1 watch", "missing parameters"},
+		{"c1 watch x", "invalid key"},
+		{"c1 watch prefix", "missing parameters"},
+		{"c1 watch prefix 1a", "invalid prefix"},
+		{"c1 watch 5 6", "invalid version"},
+		{"c1 unwatch 5 @1", "error"},
+		{"c1 auth alice", "missing parameters"},
+		{"c1 notify 5 5 1", "missing parameters"},
+		{"c1 notify 5 5 1 2", "invalid version"},
+	}
+	for _, test := range tests {
+		got := ParseText(test.line)
+		if got.Op != OpInvalid || got.Text != test.want {
+			t.Errorf("ParseText(%q) = op %s, text %q, want op invalid, text %q", test.line, got.Op, got.Text, test.want)
+		}
+	}
+}
+
+func TestTTLArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+	}{
+		{"ttl=30", 30 * time.Second},
+		{"ttl=1500ms", 1500 * time.Millisecond},
+		{"ttl=2m", 2 * time.Minute},
+		{"ttl=1ms", time.Millisecond},
+	}
+	for _, test := range tests {
+		if got, err := ParseTTLArg([]string{test.arg}); err != nil || got != test.want {
+			t.Errorf("ParseTTLArg(%q) = %s, %v, want %s", test.arg, got, err, test.want)
+		}
+	}
+	if got, err := ParseTTLArg(nil); err != nil || got != 0 {
+		t.Errorf("ParseTTLArg(nil) = %s, %v, want no ttl", got, err)
+	}
+}
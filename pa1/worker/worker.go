@@ -0,0 +1,111 @@
+// Package worker runs requests on a bounded pool of goroutines and puts
+// their replies back in arrival order.
+package worker
+
+import "sync"
+
+type Pool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+// NewPool starts size workers. Submit blocks once queue jobs are waiting,
+// which pushes back on the connection reading them.
+func NewPool(size int, queue int) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &Pool{jobs: make(chan func(), queue)}
+	for i := 0; i < size; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *Pool) Submit(job func()) {
+	p.jobs <- job
+}
+
+// TrySubmit queues job unless the queue is full, for callers that must not
+// block, and reports whether it did.
+func (p *Pool) TrySubmit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queued returns how many jobs are waiting for a worker.
+func (p *Pool) Queued() int {
+	return len(p.jobs)
+}
+
+func (p *Pool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// Sequencer releases completed work in the order it was reserved, so replies
+// to pipelined requests on one connection go out in request order even when
+// they finish out of order.
+type Sequencer struct {
+	mu       sync.Mutex
+	reserved uint64
+	next     uint64
+	done     map[uint64]func()
+	idle     *sync.Cond
+}
+
+func NewSequencer() *Sequencer {
+	s := &Sequencer{done: make(map[uint64]func())}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Sequencer) Reserve() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.reserved
+	s.reserved++
+	return seq
+}
+
+// Complete records the delivery for seq and runs every delivery that is now
+// in order. deliver may be nil when there is nothing to send.
+func (s *Sequencer) Complete(seq uint64, deliver func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if deliver == nil {
+		deliver = func() {}
+	}
+	s.done[seq] = deliver
+	for {
+		next, ok := s.done[s.next]
+		if !ok {
+			break
+		}
+		delete(s.done, s.next)
+		s.next++
+		next()
+	}
+	if s.next == s.reserved {
+		s.idle.Broadcast()
+	}
+}
+
+// Wait blocks until every reserved sequence number has completed.
+func (s *Sequencer) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.next != s.reserved {
+		s.idle.Wait()
+	}
+}